@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go/build"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// BuildCheck compiles the test binary of the package in dir, without
+// running it, and reports if it was successful. If the build fails the
+// compiler's diagnostics are returned. An error is only returned if the
+// go command could not be run or ctx was cancelled, in which case the go
+// command and the compiler processes it started are killed.
+func BuildCheck(ctx context.Context, ctxt *build.Context, dir string) (bool, []string, error) {
+	var stderr bytes.Buffer
+	// See runTests for why ctx is not passed to the command.
+	cmd := goCommand(context.Background(), ctxt, dir, "test", "-c", "-o", os.DevNull)
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return false, nil, err
+	}
+	if err := cancelProcessGroup(ctx, cmd)(); err != nil {
+		if ctx.Err() != nil {
+			return false, nil, ctx.Err()
+		}
+		var eerr *exec.ExitError
+		if !errors.As(err, &eerr) {
+			return false, nil, err
+		}
+		return false, buildErrors(stderr.String()), nil
+	}
+	return true, nil, nil
+}
+
+// buildErrors returns the diagnostics printed by the go command, omitting
+// the "# pkg" headers.
+func buildErrors(stderr string) []string {
+	var errs []string
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		errs = append(errs, line)
+	}
+	return errs
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	util "golang.org/x/tools/go/buildutil"
+)
+
+// PackageBuildID returns a hex encoded SHA-256 hash identifying the inputs
+// used to build the test binary of pkg. The hash covers, in order:
+//
+//   - The GOOS and GOARCH of ctxt.
+//   - The sorted build tags of ctxt.
+//   - The names and contents, sorted by name, of the package's Go, cgo,
+//     test and external test files (read through ctxt so overlays are
+//     respected).
+//   - The contents of the go.mod and go.sum files of the package's module,
+//     if any.
+//
+// Dependencies are only accounted for through go.mod and go.sum, so the
+// ID will not change if a dependency replaced by a local directory is
+// modified.
+func PackageBuildID(ctxt *build.Context, pkg *build.Package) (string, error) {
+	h := sha256.New()
+	tags := append([]string(nil), ctxt.BuildTags...)
+	sort.Strings(tags)
+	fmt.Fprintf(h, "goos %s\ngoarch %s\ntags %s\n", ctxt.GOOS, ctxt.GOARCH,
+		strings.Join(tags, ","))
+
+	var names []string
+	for _, list := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles, pkg.XTestGoFiles} {
+		names = append(names, list...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := hashFile(h, ctxt, util.JoinPath(ctxt, pkg.Dir, name), name); err != nil {
+			return "", err
+		}
+	}
+
+	if gomod, ok := findParentFile(pkg.Dir, "go.mod"); ok {
+		if err := hashFile(h, ctxt, gomod, "go.mod"); err != nil {
+			return "", err
+		}
+		gosum := filepath.Join(filepath.Dir(gomod), "go.sum")
+		if err := hashFile(h, ctxt, gosum, "go.sum"); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h io.Writer, ctxt *build.Context, filename, name string) error {
+	f, err := util.OpenFile(ctxt, filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "file %s %d\n", name, len(data))
+	_, err = h.Write(data)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// A Closure is a function literal that takes a *testing.T parameter. These
+// are not runnable by "go test" directly, but are useful for navigation.
+type Closure struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line"`
+	// Func is the name of the enclosing function declaration, if any.
+	Func string `json:"func,omitempty"`
+	// Var is the name of the variable the closure is assigned to, if any.
+	Var string `json:"var,omitempty"`
+}
+
+// isTestingT reports if expr is *testing.T where testingName is the name
+// the "testing" package is imported as.
+func isTestingT(testingName string, expr ast.Expr) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "T" {
+		return false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	return ok && id.Name == testingName
+}
+
+func hasTestingTParam(testingName string, ft *ast.FuncType) bool {
+	if ft.Params == nil {
+		return false
+	}
+	for _, f := range ft.Params.List {
+		if isTestingT(testingName, f.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRunCall reports if call is a method call named Run, such as t.Run.
+func isRunCall(call *ast.CallExpr) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Run"
+}
+
+// findClosures returns the function literals of af that take a *testing.T
+// parameter and are not subtests (passed directly to a Run method).
+func findClosures(fset *token.FileSet, af *ast.File, imports map[string]string) []*Closure {
+	testingName := testingImportName(imports)
+	if testingName == "" {
+		return nil
+	}
+
+	var closures []*Closure
+	for _, decl := range af.Decls {
+		var funcName string
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Name != nil {
+			funcName = d.Name.Name
+		}
+		// Function literals to ignore or name, keyed by literal
+		subtests := make(map[*ast.FuncLit]bool)
+		vars := make(map[*ast.FuncLit]string)
+		ast.Inspect(decl, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.CallExpr:
+				if isRunCall(x) {
+					for _, arg := range x.Args {
+						if lit, ok := arg.(*ast.FuncLit); ok {
+							subtests[lit] = true
+						}
+					}
+				}
+			case *ast.AssignStmt:
+				if len(x.Lhs) == len(x.Rhs) {
+					for i, rhs := range x.Rhs {
+						lit, ok := rhs.(*ast.FuncLit)
+						if id, isIdent := x.Lhs[i].(*ast.Ident); ok && isIdent {
+							vars[lit] = id.Name
+						}
+					}
+				}
+			case *ast.ValueSpec:
+				if len(x.Names) == len(x.Values) {
+					for i, val := range x.Values {
+						if lit, ok := val.(*ast.FuncLit); ok {
+							vars[lit] = x.Names[i].Name
+						}
+					}
+				}
+			case *ast.FuncLit:
+				if !subtests[x] && hasTestingTParam(testingName, x.Type) {
+					pos := fset.Position(x.Pos())
+					closures = append(closures, &Closure{
+						Filename: pos.Filename,
+						Line:     pos.Line,
+						Func:     funcName,
+						Var:      vars[x],
+					})
+				}
+			}
+			return true
+		})
+	}
+	return closures
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the configuration files searched for in the working directory
+// and its parents.
+const (
+	ConfigFileName     = ".gotest-util.json"
+	YAMLConfigFileName = ".gotest-util.yaml"
+)
+
+// A Config maps the names of persistent flags to their default values. The
+// values may be strings, booleans, numbers or, for flags that take a comma
+// separated list like --tags, arrays of strings. For example:
+//
+//	{
+//		"tags": ["integration", "linux"],
+//		"race": true
+//	}
+//
+// or in YAML:
+//
+//	tags: [integration, linux]
+//	race: true
+//
+// Flags given on the command line take precedence over the config file,
+// which takes precedence over the flag's default value.
+type Config map[string]interface{}
+
+// findConfigFile returns the path of the nearest config file found in dir
+// or any of its parents. It is an error for a directory to contain both a
+// JSON and a YAML config file.
+func findConfigFile(dir string) (string, bool, error) {
+	for d := dir; ; {
+		var found []string
+		for _, name := range []string{ConfigFileName, YAMLConfigFileName} {
+			filename := filepath.Join(d, name)
+			if fi, err := os.Stat(filename); err == nil && fi.Mode().IsRegular() {
+				found = append(found, filename)
+			}
+		}
+		switch len(found) {
+		case 1:
+			return found[0], true, nil
+		case 2:
+			return "", false, fmt.Errorf("both %s and %s exist: remove one of them",
+				found[0], YAMLConfigFileName)
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return "", false, nil
+		}
+		d = parent
+	}
+}
+
+// loadConfig reads the config file filename, which is parsed as YAML if
+// its extension is ".yaml" and as JSON otherwise.
+func loadConfig(filename string) (Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if filepath.Ext(filename) == ".yaml" {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		return cfg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// configValue returns v in the form expected by pflag.Value.Set.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []interface{}:
+		a := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", fmt.Errorf("invalid array element: %v", e)
+			}
+			a[i] = s
+		}
+		return strings.Join(a, ","), nil
+	}
+	return "", fmt.Errorf("invalid value: %v", v)
+}
+
+// applyConfig sets the persistent flags of cmd that were not given on the
+// command line to their values in cfg.
+func applyConfig(cmd *cobra.Command, cfg Config, filename string) error {
+	flags := cmd.Flags()
+	for name, v := range cfg {
+		if cmd.Root().PersistentFlags().Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag: %q", filename, name)
+		}
+		if flags.Changed(name) {
+			continue
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: flag %q: %w", filename, name, err)
+		}
+		if err := flags.Set(name, s); err != nil {
+			return fmt.Errorf("%s: flag %q: %w", filename, name, err)
+		}
+	}
+	return nil
+}
+
+// loadConfigFlags finds the config file for the working directory, if any,
+// and applies it to cmd.
+func loadConfigFlags(cmd *cobra.Command) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	filename, ok, err := findConfigFile(wd)
+	if !ok {
+		return err
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		return err
+	}
+	return applyConfig(cmd, cfg, filepath.Clean(filename))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/charlievieth/buildutil"
+)
+
+var (
+	knownOS   = stringSet(buildutil.KnownOSList())
+	knownArch = stringSet(buildutil.KnownArchList())
+)
+
+func stringSet(a []string) map[string]bool {
+	m := make(map[string]bool, len(a))
+	for _, s := range a {
+		m[s] = true
+	}
+	return m
+}
+
+// fileNameConstraint returns the constraint implied by the GOOS and GOARCH
+// suffixes of filename ("foo_linux_amd64_test.go"), if any. The rules are
+// the same as those used by go/build.
+func fileNameConstraint(filename string) constraint.Expr {
+	name := strings.TrimSuffix(filepath.Base(filename), ".go")
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return nil
+	}
+	l := strings.Split(name[i:], "_")
+	if n := len(l); n > 0 && l[n-1] == "test" {
+		l = l[:n-1]
+	}
+	n := len(l)
+	if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+		return &constraint.AndExpr{
+			X: &constraint.TagExpr{Tag: l[n-2]},
+			Y: &constraint.TagExpr{Tag: l[n-1]},
+		}
+	}
+	if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+		return &constraint.TagExpr{Tag: l[n-1]}
+	}
+	return nil
+}
+
+// commentConstraint returns the build constraint declared by the "//go:build"
+// line of af or, if there is none, the combined "// +build" lines.
+func commentConstraint(af *ast.File) (constraint.Expr, error) {
+	var plus constraint.Expr
+	for _, g := range af.Comments {
+		if g.Pos() >= af.Package {
+			break
+		}
+		for _, c := range g.List {
+			switch {
+			case constraint.IsGoBuild(c.Text):
+				return constraint.Parse(c.Text)
+			case constraint.IsPlusBuild(c.Text):
+				x, err := constraint.Parse(c.Text)
+				if err != nil {
+					return nil, err
+				}
+				plus = andExpr(plus, x)
+			}
+		}
+	}
+	return plus, nil
+}
+
+func andExpr(x, y constraint.Expr) constraint.Expr {
+	if x == nil {
+		return y
+	}
+	if y == nil {
+		return x
+	}
+	return &constraint.AndExpr{X: x, Y: y}
+}
+
+// FileConstraint returns the complete build constraint of the file af named
+// filename: its "//go:build" expression and any GOOS/GOARCH implied by its
+// name. A nil Expr is returned if the file is unconstrained.
+func FileConstraint(af *ast.File, filename string) (constraint.Expr, error) {
+	x, err := commentConstraint(af)
+	if err != nil {
+		return nil, err
+	}
+	return andExpr(x, fileNameConstraint(filename)), nil
+}
+
+// constraintTags adds the tags referenced by x to tags.
+func constraintTags(x constraint.Expr, tags map[string]bool) {
+	switch x := x.(type) {
+	case *constraint.TagExpr:
+		tags[x.Tag] = true
+	case *constraint.NotExpr:
+		constraintTags(x.X, tags)
+	case *constraint.AndExpr:
+		constraintTags(x.X, tags)
+		constraintTags(x.Y, tags)
+	case *constraint.OrExpr:
+		constraintTags(x.X, tags)
+		constraintTags(x.Y, tags)
+	}
+}
+
+// stringSetKeys returns the sorted keys of m or nil if it is empty.
+func stringSetKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	a := make([]string, 0, len(m))
+	for s := range m {
+		a = append(a, s)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// archTargets returns the sorted GOARCH values for which the build
+// constraint x can be satisfied or nil if x does not depend on the
+// architecture. Tags other than GOARCH values, such as GOOS values or
+// custom tags, may take either value.
+func archTargets(x constraint.Expr) []string {
+	if x == nil {
+		return nil
+	}
+	tags := make(map[string]bool)
+	constraintTags(x, tags)
+	var free []string
+	archSpecific := false
+	for tag := range tags {
+		if knownArch[tag] {
+			archSpecific = true
+		} else {
+			free = append(free, tag)
+		}
+	}
+	if !archSpecific {
+		return nil
+	}
+	// Only a bounded number of free tags is enumerated, beyond which the
+	// constraint is assumed to be satisfiable.
+	const maxFree = 10
+	var archs []string
+	for arch := range knownArch {
+		if len(free) > maxFree || satisfiable(x, arch, free) {
+			archs = append(archs, arch)
+		}
+	}
+	if len(archs) == len(knownArch) {
+		return nil
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// satisfiable reports if x is true for GOARCH arch for any assignment of
+// the free tags.
+func satisfiable(x constraint.Expr, arch string, free []string) bool {
+	for mask := 0; mask < 1<<len(free); mask++ {
+		ok := x.Eval(func(tag string) bool {
+			if knownArch[tag] {
+				return tag == arch
+			}
+			for i, t := range free {
+				if t == tag {
+					return mask&(1<<i) != 0
+				}
+			}
+			return false
+		})
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredBuildTags returns the smallest sorted set of custom build tags
+// that must be passed to "go test -tags" for the build constraint x to be
+// satisfied by ctxt. Of the sets of the same size the one with the most
+// tags of ctxt.BuildTags is preferred. Tags set by ctxt, such as GOOS,
+// GOARCH and release tags, are never included. Nil is returned if no
+// custom tags are needed or x cannot be satisfied.
+func requiredBuildTags(ctxt *build.Context, x constraint.Expr) []string {
+	if x == nil {
+		return nil
+	}
+	tags := make(map[string]bool)
+	constraintTags(x, tags)
+	var free []string
+	for tag := range tags {
+		if !contextTag(ctxt, tag) {
+			free = append(free, tag)
+		}
+	}
+	// Like archTargets only a bounded number of tags is enumerated.
+	const maxFree = 10
+	if len(free) == 0 || len(free) > maxFree {
+		return nil
+	}
+	sort.Strings(free)
+	c := buildutil.NewConstraint(x, nil)
+	active := stringSet(ctxt.BuildTags)
+	tctxt := *ctxt
+	var best []string
+	bestActive := 0
+	for mask := 0; mask < 1<<len(free); mask++ {
+		var set []string
+		n := 0 // active tags in set
+		for i, tag := range free {
+			if mask&(1<<i) != 0 {
+				set = append(set, tag)
+				if active[tag] {
+					n++
+				}
+			}
+		}
+		if best != nil && (len(set) > len(best) || len(set) == len(best) && n <= bestActive) {
+			continue
+		}
+		tctxt.BuildTags = set
+		if c.Eval(&tctxt) {
+			if len(set) == 0 {
+				return nil
+			}
+			best, bestActive = set, n
+		}
+	}
+	return best
+}
+
+// contextTag reports if tag is set, or may be set, by ctxt itself rather
+// than the -tags flag.
+func contextTag(ctxt *build.Context, tag string) bool {
+	if knownOS[tag] || knownArch[tag] || strings.HasPrefix(tag, "goexperiment.") {
+		return true
+	}
+	switch tag {
+	case "cgo", "gc", "gccgo", "unix", ctxt.Compiler:
+		return true
+	}
+	for _, list := range [][]string{ctxt.ReleaseTags, ctxt.ToolTags} {
+		for _, t := range list {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// A CoverBlock is a single block of a Go coverage profile attributed to the
+// test that executed it.
+type CoverBlock struct {
+	Test      string
+	Filename  string
+	StartLine int
+	EndLine   int
+	Count     int
+}
+
+// ParseTestCoverProfile parses a Go coverage profile that has been annotated
+// with the name of the test that produced each block. The expected format is
+// that of "go test -coverprofile" with "# test: NAME" lines marking the start
+// of the blocks covered by test NAME, for example:
+//
+//	mode: set
+//	# test: TestFoo
+//	example.com/pkg/foo.go:10.2,12.16 2 1
+//	# test: TestBar
+//	example.com/pkg/foo.go:10.2,12.16 2 0
+//	example.com/pkg/bar.go:4.31,6.2 1 1
+//
+// Multiple profiles may be concatenated (so "mode:" lines may be repeated).
+// Blocks that precede any "# test:" line are not attributed to a test and
+// are ignored, as are blocks with a count of zero.
+func ParseTestCoverProfile(r io.Reader) ([]CoverBlock, error) {
+	var blocks []CoverBlock
+	var test string
+	sc := bufio.NewScanner(r)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "mode:"):
+			continue
+		case strings.HasPrefix(line, "#"):
+			s := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if strings.HasPrefix(s, "test:") {
+				test = strings.TrimSpace(strings.TrimPrefix(s, "test:"))
+			}
+			continue
+		}
+		b, err := parseCoverBlock(line)
+		if err != nil {
+			return nil, fmt.Errorf("coverprofile: line %d: %w", lineno, err)
+		}
+		if test == "" || b.Count == 0 {
+			continue
+		}
+		b.Test = test
+		blocks = append(blocks, b)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// parseCoverBlock parses a profile line of the form:
+//
+//	name.go:line.column,line.column numberOfStatements count
+func parseCoverBlock(line string) (CoverBlock, error) {
+	var b CoverBlock
+	i := strings.LastIndexByte(line, ':')
+	if i == -1 {
+		return b, fmt.Errorf("invalid block: %q", line)
+	}
+	b.Filename = line[:i]
+	fields := strings.Fields(line[i+1:])
+	if len(fields) != 3 {
+		return b, fmt.Errorf("invalid block: %q", line)
+	}
+	start, end, ok := strings.Cut(fields[0], ",")
+	if !ok {
+		return b, fmt.Errorf("invalid block range: %q", fields[0])
+	}
+	var err error
+	if b.StartLine, err = parseCoverLine(start); err != nil {
+		return b, err
+	}
+	if b.EndLine, err = parseCoverLine(end); err != nil {
+		return b, err
+	}
+	if b.Count, err = strconv.Atoi(fields[2]); err != nil {
+		return b, fmt.Errorf("invalid block count: %w", err)
+	}
+	return b, nil
+}
+
+func parseCoverLine(s string) (int, error) {
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		s = s[:i]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block line: %w", err)
+	}
+	return n, nil
+}
+
+// moduleFilePath returns the import path qualified name of filename (the
+// form used by coverage profiles) by locating the go.mod file of its module.
+func moduleFilePath(filename string) (string, bool) {
+	ipath, ok := moduleImportPath(filepath.Dir(filename))
+	if !ok {
+		return "", false
+	}
+	return path.Join(ipath, filepath.Base(filename)), true
+}
+
+// moduleImportPath returns the import path of the package in directory dir
+// by locating the go.mod file of its module.
+func moduleImportPath(dir string) (string, bool) {
+	gomod, ok := findParentFile(dir, "go.mod")
+	if !ok {
+		return "", false
+	}
+	data, err := os.ReadFile(gomod)
+	if err != nil {
+		return "", false
+	}
+	modpath := modulePath(data)
+	if modpath == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Dir(gomod), dir)
+	if err != nil {
+		return "", false
+	}
+	// The import paths of the standard library ("$GOROOT/src/go.mod")
+	// are not prefixed by its module path.
+	if modpath == "std" {
+		return filepath.ToSlash(rel), rel != "."
+	}
+	return path.Join(modpath, filepath.ToSlash(rel)), true
+}
+
+// goDirective returns the version of the go directive of the go.mod file of
+// the module containing directory dir, such as "1.19".
+func goDirective(dir string) (string, bool) {
+	gomod, ok := findParentFile(dir, "go.mod")
+	if !ok {
+		return "", false
+	}
+	data, err := os.ReadFile(gomod)
+	if err != nil {
+		return "", false
+	}
+	f, err := modfile.ParseLax(gomod, data, nil)
+	if err != nil || f.Go == nil {
+		return "", false
+	}
+	return f.Go.Version, true
+}
+
+// findParentFile returns the path of the first file named name found in dir
+// or any of its parent directories.
+func findParentFile(dir, name string) (string, bool) {
+	for d := dir; ; {
+		filename := filepath.Join(d, name)
+		if fi, err := os.Stat(filename); err == nil && fi.Mode().IsRegular() {
+			return filename, true
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return "", false
+		}
+		d = parent
+	}
+}
+
+// modulePath returns the module path declared by the go.mod file data.
+func modulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "module") {
+			s := strings.TrimSpace(strings.TrimPrefix(line, "module"))
+			if i := strings.Index(s, "//"); i != -1 {
+				s = strings.TrimSpace(s[:i])
+			}
+			return strings.Trim(s, "\"`")
+		}
+	}
+	return ""
+}
+
+// coverFileMatches reports if the profile file name (which is usually an
+// import path followed by the file name) refers to filename. The modName
+// argument is the import path qualified name of filename, if known.
+func coverFileMatches(profileName, filename, modName string) bool {
+	if modName != "" {
+		return profileName == modName
+	}
+	name := filepath.ToSlash(filepath.Clean(filename))
+	profileName = filepath.ToSlash(profileName)
+	return name == profileName || strings.HasSuffix(name, "/"+profileName)
+}
+
+// TestsCoveringLine returns the sorted names of the tests whose blocks cover
+// line of filename.
+func TestsCoveringLine(blocks []CoverBlock, filename string, line int) []string {
+	modName, _ := moduleFilePath(filename)
+	seen := make(map[string]bool)
+	tests := []string{}
+	for _, b := range blocks {
+		if b.StartLine <= line && line <= b.EndLine && !seen[b.Test] &&
+			coverFileMatches(b.Filename, filename, modName) {
+			seen[b.Test] = true
+			tests = append(tests, b.Test)
+		}
+	}
+	sort.Strings(tests)
+	return tests
+}
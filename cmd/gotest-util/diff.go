@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseDiffLines returns the lines changed by the unified diff read from r
+// keyed by the name of the new file. Added lines are reported by their line
+// number in the new file and removed lines by the line of the new file that
+// follows them. The "a/" and "b/" prefixes of git diffs are removed and
+// deleted files are ignored.
+func ParseDiffLines(r io.Reader) (map[string][]int, error) {
+	changed := make(map[string][]int)
+	var (
+		filename string
+		line     int // current line of the new file
+		oldLeft  int // lines of the old file remaining in the hunk
+		newLeft  int // lines of the new file remaining in the hunk
+	)
+	add := func(n int) {
+		if filename == "" {
+			return
+		}
+		a := changed[filename]
+		if len(a) == 0 || a[len(a)-1] != n {
+			changed[filename] = append(a, n)
+		}
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for lineno := 1; sc.Scan(); lineno++ {
+		text := sc.Text()
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(text, "+"):
+				add(line)
+				line++
+				newLeft--
+			case strings.HasPrefix(text, "-"):
+				add(line)
+				oldLeft--
+			case strings.HasPrefix(text, "\\"):
+				// "\ No newline at end of file"
+			default:
+				line++
+				oldLeft--
+				newLeft--
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text, "+++ "):
+			filename = diffFileName(text[len("+++ "):])
+		case strings.HasPrefix(text, "@@ "):
+			var err error
+			oldLeft, line, newLeft, err = parseHunkHeader(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// diffFileName returns the file name of a "+++" line of a unified diff or
+// an empty string if the file was deleted.
+func diffFileName(s string) string {
+	// Some diff programs append a timestamp separated by a tab.
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return ""
+	}
+	if unq, err := strconv.Unquote(s); err == nil {
+		s = unq // git quotes unusual names
+	}
+	return strings.TrimPrefix(s, "b/")
+}
+
+// parseHunkHeader parses a hunk header of the form
+// "@@ -l,s +l,s @@" and returns the number of old lines and the first line
+// and number of new lines of the hunk.
+func parseHunkHeader(s string) (oldCount, newStart, newCount int, err error) {
+	f := strings.Fields(s)
+	if len(f) < 4 || f[3] != "@@" || !strings.HasPrefix(f[1], "-") ||
+		!strings.HasPrefix(f[2], "+") {
+		return 0, 0, 0, fmt.Errorf("invalid hunk header: %q", s)
+	}
+	_, oldCount, err = parseHunkRange(f[1][1:])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid hunk header: %q", s)
+	}
+	newStart, newCount, err = parseHunkRange(f[2][1:])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid hunk header: %q", s)
+	}
+	return oldCount, newStart, newCount, nil
+}
+
+func parseHunkRange(s string) (start, count int, err error) {
+	count = 1
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		if count, err = strconv.Atoi(s[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+	start, err = strconv.Atoi(s)
+	return start, count, err
+}
+
+// An AffectedFunction is a function containing lines changed by a diff.
+type AffectedFunction struct {
+	FuncRef
+	EndLine int    `json:"end_line"`
+	Kind    string `json:"kind"` // "test", "benchmark", "example", "fuzz", "function" or "method"
+}
+
+// funcKindName returns the kind of function d declared in file filename.
+func funcKindName(filename string, d *ast.FuncDecl) string {
+	if d.Recv != nil {
+		return "method"
+	}
+	if strings.HasSuffix(filename, "_test.go") {
+		switch testFuncKind(d.Name.Name) {
+		case kindTest:
+			return "test"
+		case kindBenchmark:
+			return "benchmark"
+		case kindExample:
+			return "example"
+		case kindFuzz:
+			return "fuzz"
+		}
+	}
+	return "function"
+}
+
+// AffectedFunctions returns the distinct functions that contain any of the
+// changed lines, which are keyed by file name (see ParseDiffLines), sorted
+// by file name and line. Files that are not Go files or no longer exist are
+// ignored.
+func AffectedFunctions(ctxt *build.Context, changed map[string][]int) ([]AffectedFunction, error) {
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		if strings.HasSuffix(name, ".go") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	affected := []AffectedFunction{}
+	fset := token.NewFileSet()
+	for _, name := range names {
+		src, err := readFile(ctxt, name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		// Use any partial AST so that the functions of a file that is
+		// being edited are still reported.
+		af, err := parser.ParseFile(fset, name, src, parser.SkipObjectResolution)
+		if af == nil {
+			return nil, err
+		}
+		lines := changed[name]
+		for _, decl := range af.Decls {
+			d, ok := decl.(*ast.FuncDecl)
+			if !ok || d.Name == nil {
+				continue
+			}
+			start := fset.Position(d.Pos())
+			end := fset.Position(d.End()).Line
+			// The doc comment is considered part of the function.
+			first := start.Line
+			if d.Doc != nil {
+				first = fset.Position(d.Doc.Pos()).Line
+			}
+			for _, n := range lines {
+				if first <= n && n <= end {
+					affected = append(affected, AffectedFunction{
+						FuncRef: FuncRef{
+							Name:     d.Name.Name,
+							Filename: name,
+							Line:     start.Line,
+						},
+						EndLine: end,
+						Kind:    funcKindName(name, d),
+					})
+					break
+				}
+			}
+		}
+	}
+	return affected, nil
+}
@@ -3,16 +3,188 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
 )
 
+// windowsReservedChars are the characters, in addition to '%', that are
+// percent-encoded by escapePathOS on Windows.
+const windowsReservedChars = `*."/\[]:;|,`
+
+// maxEscapedName is the maximum length of an escaped file name. The max file
+// name is 255 on Darwin and 259 on Windows so use 254 to be safe.
+const maxEscapedName = 254
+
 func shouldHashPath(s string) bool {
-	// The max file name is 255 on Darwin and 259 on Windows so use 254 to be safe.
-	return len(s) >= 254-len(".test.exe")
+	return len(s) >= maxEscapedName-len(".test.exe")
+}
+
+// HashPathBytes is the number of bytes of the SHA-256 hash of a path used
+// by hashEscapePath, which is encoded as twice as many hex characters. It
+// must be between 8 and sha256.Size. The default of 16 bytes (128 bits)
+// makes collisions negligible even for a cache shared by many packages.
+var HashPathBytes = 16
+
+// hashedPathPrefix is the prefix of hashed names. It cannot start an
+// escaped path since escapePathOS always percent-encodes '%' and 'H' is
+// not a hex digit.
+const hashedPathPrefix = "%H"
+
+// hashEscapePath returns the hashed file name of path s on the target OS
+// goos. The path is cleaned and split using the separators of goos so that
+// the name does not depend on the host OS.
+func hashEscapePath(s, goos string) string {
+	n := HashPathBytes
+	if n < 8 {
+		n = 8
+	} else if n > sha256.Size {
+		n = sha256.Size
+	}
+	s = cleanPathOS(s, goos)
+	h := sha256.Sum256([]byte(s))
+	sum := hex.EncodeToString(h[:n])
+	// The base name is only informative so escape it, like the full path,
+	// and truncate it, at an escape and rune boundary, to keep the name
+	// within maxEscapedName.
+	sep := byte('/')
+	if goos == "windows" {
+		sep = '\\'
+	}
+	base := s[strings.LastIndexByte(s, sep)+1:]
+	base = escapeReserved(base, reservedCharsOS(goos))
+	if limit := maxEscapedName - len(hashedPathPrefix) - len(sum) - len(".") - len(".test.exe"); len(base) > limit {
+		for limit > 0 && !utf8.RuneStart(base[limit]) {
+			limit--
+		}
+		if i := strings.LastIndexByte(base[:limit], '%'); i >= 0 && i > limit-3 {
+			limit = i
+		}
+		base = base[:limit]
+	}
+	return hashedPathPrefix + sum + "." + base + ".test.exe" // Add the ".exe" for Windows
+}
+
+// cleanPathOS returns the shortest path equivalent to s on the target OS
+// goos (see path.Clean). On Windows both '/' and '\' are separators, the
+// result is separated by '\', and the leading `\\` of a UNC path is kept.
+func cleanPathOS(s, goos string) string {
+	if goos != "windows" {
+		return path.Clean(s)
+	}
+	s = strings.Replace(s, `\`, "/", -1)
+	unc := strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "///")
+	s = path.Clean(s)
+	if unc {
+		s = "/" + s
+	}
+	return strings.Replace(s, "/", `\`, -1)
+}
+
+// reservedCharsOS returns the characters percent-encoded by escapePathOS.
+func reservedCharsOS(goos string) string {
+	if goos == "windows" {
+		return windowsReservedChars + "%"
+	}
+	return "/%"
+}
+
+// escapeReserved percent-encodes the characters of s that are in reserved.
+func escapeReserved(s, reserved string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; strings.IndexByte(reserved, c) >= 0 {
+			b.WriteByte('%')
+			b.WriteByte(upperhex[c>>4])
+			b.WriteByte(upperhex[c&15])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// escapePath escapes path s for use as a file name on the host OS.
+func escapePath(s string) string {
+	return escapePathOS(s, runtime.GOOS)
+}
+
+// escapePathOS escapes path s for use as a file name on the target OS goos.
+// Path separators (and on Windows other reserved characters) and '%' are
+// percent-encoded ("/a/b" => "%2Fa%2Fb") so that the path can be recovered
+// with unescapePath. Paths whose escaped form is too long for a file name
+// are hashed, which cannot be reversed (see hashEscapePath).
+func escapePathOS(s, goos string) string {
+	if goos != "windows" {
+		s = filepath.ToSlash(s)
+	}
+	if name := escapeReserved(s, reservedCharsOS(goos)); !shouldHashPath(name) {
+		return name
+	}
+	return hashEscapePath(s, goos)
+}
+
+const upperhex = "0123456789ABCDEF"
+
+// errHashedPath is returned by unescapePath for hashed paths.
+var errHashedPath = errors.New("escaped path is hashed and cannot be reversed")
+
+// unescapePath returns the path escaped by escapePath as s. An error is
+// returned if s is not a valid escaped path or the path was hashed.
+func unescapePath(s string) (string, error) {
+	if isHashedPath(s) {
+		return "", fmt.Errorf("unescape %q: %w", s, errHashedPath)
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return "", fmt.Errorf("unescape %q: invalid escape at offset %d", s, i)
+		}
+		b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// isHashedPath reports if s was produced by hashEscapePath: hashedPathPrefix,
+// a hex encoded hash, "." and a base name ending in ".test.exe".
+func isHashedPath(s string) bool {
+	if !strings.HasPrefix(s, hashedPathPrefix) || !strings.HasSuffix(s, ".test.exe") {
+		return false
+	}
+	s = s[len(hashedPathPrefix):]
+	i := strings.IndexByte(s, '.')
+	if i < 2*8 || i > 2*sha256.Size || i%2 != 0 {
+		return false
+	}
+	for j := 0; j < i; j++ {
+		if !isHex(s[j]) || 'A' <= s[j] && s[j] <= 'F' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
 }
 
-func hashEscapePath(s string) string {
-	h := sha256.Sum256([]byte(filepath.Clean(s)))
-	sum := hex.EncodeToString(h[:8])
-	return sum + "." + filepath.Base(s) + ".test.exe" // Add the ".exe" for Windows
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEscapePathOS(t *testing.T) {
+	tests := []struct {
+		path, goos, want string
+	}{
+		{"/a/b", "linux", "%2Fa%2Fb"},
+		{"/a/b", "darwin", "%2Fa%2Fb"},
+		{"/a%b/c.d", "linux", "%2Fa%25b%2Fc.d"},
+		{"/a:b/c", "linux", "%2Fa:b%2Fc"},
+		{`C:\a\b.c`, "windows", "C%3A%5Ca%5Cb%2Ec"},
+		{"/a/b", "windows", "%2Fa%2Fb"},
+		{`C:\a%b\[c]`, "windows", "C%3A%5Ca%25b%5C%5Bc%5D"},
+	}
+	for _, test := range tests {
+		if got := escapePathOS(test.path, test.goos); got != test.want {
+			t.Errorf("escapePathOS(%q, %q) = %q; want: %q", test.path, test.goos, got, test.want)
+		}
+	}
+}
+
+func TestEscapePathHostOS(t *testing.T) {
+	const path = "/a/b.c"
+	if got, want := escapePath(path), escapePathOS(path, runtime.GOOS); got != want {
+		t.Errorf("escapePath(%q) = %q; want: %q", path, got, want)
+	}
+}
+
+// genPaths returns all paths of length 1 through n made of the characters
+// in alphabet.
+func genPaths(alphabet string, n int) []string {
+	paths := []string{""}
+	var all []string
+	for i := 0; i < n; i++ {
+		var next []string
+		for _, p := range paths {
+			for j := 0; j < len(alphabet); j++ {
+				next = append(next, p+alphabet[j:j+1])
+			}
+		}
+		all = append(all, next...)
+		paths = next
+	}
+	return all
+}
+
+func TestEscapePathUnique(t *testing.T) {
+	// Include the characters of escape sequences so that, for example,
+	// "a/b" and "a%2Fb" would collide if '%' was not escaped.
+	paths := genPaths(`ab/%2F5\.:`, 5)
+	// Names that look like hashed names must not be mistaken for them.
+	hash := strings.Repeat("deadbeef", 2)
+	paths = append(paths,
+		hash+".test.exe",
+		hash+".pkg.test.exe",
+		"%H"+hash+".pkg.test.exe",
+		"dir/"+hash+".test.exe",
+	)
+	for _, goos := range []string{"linux", "windows"} {
+		seen := make(map[string]string, len(paths))
+		for _, path := range paths {
+			name := escapePathOS(path, goos)
+			if prev, ok := seen[name]; ok {
+				t.Fatalf("%s: escapePathOS(%q) == escapePathOS(%q) == %q", goos, path, prev, name)
+			}
+			seen[name] = path
+			got, err := unescapePath(name)
+			if err != nil {
+				t.Fatalf("%s: unescapePath(%q): %v", goos, name, err)
+			}
+			if got != path {
+				t.Fatalf("%s: unescapePath(escapePathOS(%q)) = %q", goos, path, got)
+			}
+		}
+	}
+}
+
+func TestUnescapePathHashed(t *testing.T) {
+	path := "/" + strings.Repeat("a/", maxEscapedName) + "pkg"
+	name := escapePathOS(path, "linux")
+	if !isHashedPath(name) {
+		t.Fatalf("escapePathOS(%q) = %q; want a hashed path", path, name)
+	}
+	if _, err := unescapePath(name); !errors.Is(err, errHashedPath) {
+		t.Errorf("unescapePath(%q) = %v; want: %v", name, err, errHashedPath)
+	}
+	for _, s := range []string{"%", "%2", "%zz", "a%2"} {
+		if _, err := unescapePath(s); err == nil {
+			t.Errorf("unescapePath(%q): expected an error", s)
+		}
+	}
+}
+
+func TestHashEscapePathLong(t *testing.T) {
+	for _, target := range []struct {
+		goos, dir, sep string
+	}{
+		{"linux", "/" + strings.Repeat("d", maxEscapedName), "/"},
+		{"windows", `C:\` + strings.Repeat("d", maxEscapedName), `\`},
+	} {
+		dir, sep := target.dir, target.sep
+		tests := []string{
+			dir + sep + "a",
+			dir + sep + "b",
+			dir + sep + "x_test",
+			dir + sep + "a:b*c|d",
+			dir + sep + strings.Repeat("x", 2*maxEscapedName),
+			dir + sep + strings.Repeat("x", 2*maxEscapedName+1),
+			dir + sep + strings.Repeat(":", maxEscapedName),
+			dir + sep + strings.Repeat("世", maxEscapedName),
+			dir + sep + "x" + strings.Repeat("世", maxEscapedName),
+			dir + sep + "xx" + strings.Repeat("世", maxEscapedName),
+		}
+		seen := make(map[string]string)
+		for _, path := range tests {
+			name := escapePathOS(path, target.goos)
+			if len(name) > maxEscapedName {
+				t.Errorf("%s: escapePathOS(%.20q...) = %d bytes; want <= %d",
+					target.goos, path, len(name), maxEscapedName)
+			}
+			if !utf8.ValidString(name) {
+				t.Errorf("%s: escapePathOS(%.20q...) = %q: invalid UTF-8", target.goos, path, name)
+			}
+			if !isHashedPath(name) {
+				t.Errorf("%s: escapePathOS(%.20q...) = %q; want a hashed path", target.goos, path, name)
+			}
+			if target.goos == "windows" && strings.ContainsAny(name, `<>:"/\|?*`) {
+				t.Errorf("%s: escapePathOS(%.20q...) = %q: invalid Windows file name",
+					target.goos, path, name)
+			}
+			if prev, ok := seen[name]; ok {
+				t.Errorf("%s: escapePathOS(%.20q...) == escapePathOS(%.20q...) == %q",
+					target.goos, path, prev, name)
+			}
+			seen[name] = path
+		}
+	}
+
+	// The name of a Windows path does not depend on the host OS or on
+	// which separator is used.
+	path := `C:\` + strings.Repeat("d", maxEscapedName) + `\x_test`
+	name := escapePathOS(path, "windows")
+	if !strings.HasSuffix(name, ".x_test.test.exe") {
+		t.Errorf("escapePathOS(%.20q..., windows) = %q; want base name %q", path, name, "x_test")
+	}
+	for _, alt := range []string{
+		strings.Replace(path, `\`, "/", -1),
+		`C:\.\` + path[len(`C:\`):],
+		strings.Replace(path, `\x_test`, `\y\..\x_test`, 1),
+	} {
+		if got := escapePathOS(alt, "windows"); got != name {
+			t.Errorf("escapePathOS(%.20q..., windows) = %q; want: %q", alt, got, name)
+		}
+	}
+}
+
+func TestCleanPathOS(t *testing.T) {
+	tests := []struct {
+		path, goos, want string
+	}{
+		{"/a/./b/../c/", "linux", "/a/c"},
+		{`/a\b`, "linux", `/a\b`},
+		{`C:\a\.\b\..\c\`, "windows", `C:\a\c`},
+		{`C:/a//b`, "windows", `C:\a\b`},
+		{`\\server\share\a\..\b`, "windows", `\\server\share\b`},
+		{`\\\a`, "windows", `\a`},
+	}
+	for _, test := range tests {
+		if got := cleanPathOS(test.path, test.goos); got != test.want {
+			t.Errorf("cleanPathOS(%q, %q) = %q; want: %q", test.path, test.goos, got, test.want)
+		}
+	}
+}
+
+func TestHashPathBytes(t *testing.T) {
+	defer func(n int) { HashPathBytes = n }(HashPathBytes)
+
+	dir := "/" + strings.Repeat("d", maxEscapedName)
+	base := strings.Repeat("b", maxEscapedName)
+	for _, n := range []int{0, 8, 16, 20, 32, 64} {
+		HashPathBytes = n
+		want := n
+		if want < 8 {
+			want = 8
+		} else if want > 32 {
+			want = 32
+		}
+		seen := make(map[string]string)
+		for i := 0; i < 10000; i++ {
+			path := fmt.Sprintf("%s/%d/%s", dir, i, base)
+			name := escapePathOS(path, "linux")
+			if len(name) > maxEscapedName {
+				t.Fatalf("HashPathBytes=%d: escapePathOS(%.20q...) = %d bytes; want <= %d",
+					n, path, len(name), maxEscapedName)
+			}
+			if j := strings.IndexByte(name, '.') - len(hashedPathPrefix); j != 2*want {
+				t.Fatalf("HashPathBytes=%d: escapePathOS(%.20q...) = %q: hash has %d hex characters; want: %d",
+					n, path, name, j, 2*want)
+			}
+			if prev, ok := seen[name]; ok {
+				t.Fatalf("HashPathBytes=%d: escapePathOS(%.20q...) == escapePathOS(%.20q...) == %q",
+					n, path, prev, name)
+			}
+			seen[name] = path
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A MalformedLine is a line of a "go test -json" stream that could not be
+// decoded as an Event. The go command may interleave plain text, such as
+// build errors, with the JSON events.
+type MalformedLine struct {
+	Line  int    `json:"line"`
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+// ParseEvents decodes the "go test -json" stream read from r. Lines that
+// are not valid events are returned as MalformedLines instead of stopping
+// the parse. An error is only returned if r cannot be read.
+func ParseEvents(r io.Reader) ([]Event, []MalformedLine, error) {
+	var events []Event
+	var malformed []MalformedLine
+	sc := bufio.NewScanner(r)
+	// Test output can be arbitrarily long.
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil || e.Action == "" {
+			msg := "missing Action"
+			if err != nil {
+				msg = err.Error()
+			}
+			malformed = append(malformed, MalformedLine{
+				Line:  lineno,
+				Text:  string(line),
+				Error: msg,
+			})
+			continue
+		}
+		events = append(events, e)
+	}
+	if err := sc.Err(); err != nil {
+		return events, malformed, err
+	}
+	return events, malformed, nil
+}
+
+// A TestResult is the outcome of a test or, if Test is empty, a package.
+type TestResult struct {
+	Package string  `json:"package"`
+	Test    string  `json:"test,omitempty"`
+	Action  string  `json:"action"` // "pass", "fail" or "skip"
+	Elapsed float64 `json:"elapsed,omitempty"`
+}
+
+// A Summary is the outcome of a test run.
+type Summary struct {
+	Packages []TestResult `json:"packages,omitempty"`
+	Tests    []TestResult `json:"tests,omitempty"`
+	Passed   int          `json:"passed"`
+	Failed   int          `json:"failed"`
+	Skipped  int          `json:"skipped"`
+
+	// Running are the tests that started but did not finish, which
+	// happens when a test panics, times out or the run is interrupted.
+	Running []TestResult `json:"running,omitempty"`
+
+	// ShuffleSeed is the seed used to shuffle the order of the tests,
+	// if they were shuffled (see ShuffleSeed).
+	ShuffleSeed *int64 `json:"shuffle_seed,omitempty"`
+
+	// ExampleFailures are the outputs of the examples that failed because
+	// they did not print their expected output.
+	ExampleFailures []ExampleFailure `json:"example_failures,omitempty"`
+
+	// Malformed are the lines of the input that were not valid events.
+	Malformed []MalformedLine `json:"malformed,omitempty"`
+
+	// Timing is the time spent building and running the test binaries
+	// (see RunTiming).
+	Timing *Timing `json:"timing,omitempty"`
+}
+
+// Summarize returns the outcome of each package and test of events. The
+// results are sorted by package and test name.
+func Summarize(events []Event) *Summary {
+	type key struct{ pkg, test string }
+	results := make(map[key]*TestResult)
+	for _, e := range events {
+		k := key{e.Package, e.Test}
+		switch e.Action {
+		case "run":
+			if _, ok := results[k]; !ok {
+				results[k] = &TestResult{Package: e.Package, Test: e.Test}
+			}
+		case "pass", "fail", "skip":
+			r := &TestResult{Package: e.Package, Test: e.Test, Action: e.Action}
+			if e.Elapsed != nil {
+				r.Elapsed = *e.Elapsed
+			}
+			results[k] = r
+		}
+	}
+
+	s := new(Summary)
+	for _, r := range results {
+		switch {
+		case r.Action == "":
+			s.Running = append(s.Running, *r)
+		case r.Test == "":
+			s.Packages = append(s.Packages, *r)
+		default:
+			s.Tests = append(s.Tests, *r)
+			switch r.Action {
+			case "pass":
+				s.Passed++
+			case "fail":
+				s.Failed++
+			case "skip":
+				s.Skipped++
+			}
+		}
+	}
+	for _, a := range [][]TestResult{s.Packages, s.Tests, s.Running} {
+		sort.Slice(a, func(i, j int) bool {
+			if a[i].Package != a[j].Package {
+				return a[i].Package < a[j].Package
+			}
+			return a[i].Test < a[j].Test
+		})
+	}
+	if seed, ok := ShuffleSeed(events); ok {
+		s.ShuffleSeed = &seed
+	}
+	s.ExampleFailures = ExampleFailures(events)
+	s.Timing = RunTiming(events, time.Time{})
+	return s
+}
+
+// A Timing splits the time, in seconds, of a test run between building
+// the test binaries and running them.
+type Timing struct {
+	// Wall is the time from the start of the run to its last event.
+	Wall float64 `json:"wall"`
+
+	// Build is the time during which any test binary was being built and
+	// Test the time during which any test binary was running. Since go
+	// test builds and runs packages in parallel the two may overlap.
+	Build float64 `json:"build"`
+	Test  float64 `json:"test"`
+
+	Packages []PackageTiming `json:"packages,omitempty"`
+}
+
+// A PackageTiming is the time, in seconds, spent building and running the
+// test binary of a package.
+type PackageTiming struct {
+	Package string `json:"package"`
+
+	// Build is the time from the start of the run until the test binary
+	// started, or the package's build failure was reported, which includes
+	// waiting for the builds of its dependencies.
+	Build float64 `json:"build"`
+
+	// Test is the time the test binary ran. Cached results take no time.
+	Test float64 `json:"test"`
+}
+
+// RunTiming returns the time spent building and running the test binaries
+// of the "go test -json" events of a run that started at start or, if it
+// is zero, at the time of the first event. The build of a package is
+// considered complete when its "start" event is reported. Packages
+// without a "start" event, which toolchains older than go1.20 do not
+// report, are considered to start with their first event. Nil is returned
+// if the events have no times.
+func RunTiming(events []Event, start time.Time) *Timing {
+	type span struct{ start, end time.Time }
+	packages := make(map[string]*span)
+	var last time.Time
+	for _, e := range events {
+		if e.Time == nil || e.Package == "" {
+			continue
+		}
+		t := *e.Time
+		if start.IsZero() || t.Before(start) {
+			start = t
+		}
+		if t.After(last) {
+			last = t
+		}
+		p := packages[e.Package]
+		if p == nil {
+			p = new(span)
+			packages[e.Package] = p
+		}
+		switch {
+		case e.Action == "start":
+			p.start = t
+		case e.Test == "" && (e.Action == "pass" || e.Action == "fail" || e.Action == "skip"):
+			p.end = t
+		}
+		if p.start.IsZero() {
+			// Toolchains older than go1.20 do not report "start".
+			p.start = t
+		}
+	}
+	if len(packages) == 0 {
+		return nil
+	}
+
+	seconds := func(d time.Duration) float64 {
+		return math.Round(d.Seconds()*1000) / 1000
+	}
+	timing := &Timing{Wall: seconds(last.Sub(start))}
+	var buildEnd time.Time
+	var running []span
+	for pkg, p := range packages {
+		end := p.end
+		if end.IsZero() {
+			end = last // interrupted
+		}
+		timing.Packages = append(timing.Packages, PackageTiming{
+			Package: pkg,
+			Build:   seconds(p.start.Sub(start)),
+			Test:    seconds(end.Sub(p.start)),
+		})
+		if p.start.After(buildEnd) {
+			buildEnd = p.start
+		}
+		running = append(running, span{p.start, end})
+	}
+	sort.Slice(timing.Packages, func(i, j int) bool {
+		return timing.Packages[i].Package < timing.Packages[j].Package
+	})
+	timing.Build = seconds(buildEnd.Sub(start))
+
+	// The time during which any test binary was running is the length of
+	// the union of their spans.
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].start.Before(running[j].start)
+	})
+	var total time.Duration
+	var cur span
+	for i, r := range running {
+		if i == 0 || r.start.After(cur.end) {
+			total += cur.end.Sub(cur.start)
+			cur = r
+		} else if r.end.After(cur.end) {
+			cur.end = r.end
+		}
+	}
+	total += cur.end.Sub(cur.start)
+	timing.Test = seconds(total)
+	return timing
+}
+
+// An ExampleFailure is the output of an example that did not match the
+// output declared by its "// Output:" comment.
+type ExampleFailure struct {
+	Package   string `json:"package"`
+	Test      string `json:"test"`
+	Got       string `json:"got"`
+	Want      string `json:"want"`
+	Unordered bool   `json:"unordered,omitempty"` // "// Unordered output:"
+}
+
+// ExampleFailures returns the output mismatches of the failed examples of
+// events, which the testing package reports as:
+//
+//	--- FAIL: ExampleFoo (0.00s)
+//	got:
+//	...
+//	want:
+//	...
+//
+// Examples that failed for other reasons, such as a panic, are omitted.
+// The failures are sorted by package and test name.
+func ExampleFailures(events []Event) []ExampleFailure {
+	type key struct{ pkg, test string }
+	output := make(map[key][]string)
+	var failures []ExampleFailure
+	for _, e := range events {
+		if !strings.HasPrefix(e.Test, "Example") {
+			continue
+		}
+		k := key{e.Package, e.Test}
+		switch e.Action {
+		case "run":
+			output[k] = nil
+		case "output":
+			if e.Output != nil {
+				output[k] = append(output[k], *e.Output)
+			}
+		case "fail":
+			if f, ok := exampleFailure(output[k]); ok {
+				f.Package = e.Package
+				f.Test = e.Test
+				failures = append(failures, f)
+			}
+			delete(output, k)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Package != failures[j].Package {
+			return failures[i].Package < failures[j].Package
+		}
+		return failures[i].Test < failures[j].Test
+	})
+	return failures
+}
+
+func exampleFailure(lines []string) (ExampleFailure, bool) {
+	var f ExampleFailure
+	got, want := -1, -1
+	for i, line := range lines {
+		switch {
+		case got == -1 && line == "got:\n":
+			got = i
+		case got != -1 && line == "want:\n":
+			want = i
+		case got != -1 && line == "want (unordered):\n":
+			want = i
+			f.Unordered = true
+		}
+		if want != -1 {
+			break
+		}
+	}
+	if got == -1 || want == -1 {
+		return f, false
+	}
+	// The testing package trims the outputs and, for unordered output,
+	// terminates each with an empty line.
+	f.Got = strings.TrimRight(strings.Join(lines[got+1:want], ""), "\n")
+	f.Want = strings.TrimRight(strings.Join(lines[want+1:], ""), "\n")
+	return f, true
+}
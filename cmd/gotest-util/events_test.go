@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunTiming(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(ms int, action, pkg, test string) Event {
+		ts := start.Add(time.Duration(ms) * time.Millisecond)
+		return Event{Time: &ts, Action: action, Package: pkg, Test: test}
+	}
+	events := []Event{
+		event(1000, "start", "a", ""),
+		event(1100, "run", "a", "TestA"),
+		event(1500, "start", "b", ""),
+		event(2000, "pass", "a", "TestA"),
+		event(2000, "pass", "a", ""),
+		event(2500, "fail", "b", ""),
+		event(3000, "start", "c", ""), // interrupted
+		event(3500, "output", "c", ""),
+	}
+	want := &Timing{
+		Wall:  3.5,
+		Build: 3,
+		Test:  2, // a and b overlap from 1.5s to 2s
+		Packages: []PackageTiming{
+			{Package: "a", Build: 1, Test: 1},
+			{Package: "b", Build: 1.5, Test: 1},
+			{Package: "c", Build: 3, Test: 0.5},
+		},
+	}
+	got := RunTiming(events, start)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RunTiming() = %+v; want: %+v", got, want)
+	}
+
+	// Without a start time the run starts with the first event.
+	got = RunTiming(events, time.Time{})
+	if got.Wall != 2.5 || got.Packages[0].Build != 0 {
+		t.Errorf("RunTiming() = %+v; want a run starting at the first event", got)
+	}
+
+	if got := RunTiming([]Event{{Action: "output"}}, start); got != nil {
+		t.Errorf("RunTiming() = %+v; want: nil for events without times", got)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The heuristics in this file are advisory: they are based on a purely
+// syntactic scan of function bodies and will have both false positives
+// and false negatives.
+
+// importNames returns a map of the names used to refer to the imports of af
+// to their import paths. Blank and dot imports are ignored.
+func importNames(af *ast.File) map[string]string {
+	m := make(map[string]string, len(af.Imports))
+	for _, spec := range af.Imports {
+		ipath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		var name string
+		if spec.Name != nil {
+			name = spec.Name.Name
+		} else {
+			name = importPathName(ipath)
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+		m[name] = ipath
+	}
+	return m
+}
+
+// importPathName returns the default package name of import path ipath
+// accounting for major version suffixes ("math/rand/v2" => "rand").
+func importPathName(ipath string) string {
+	name := path.Base(ipath)
+	if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		if dir := path.Dir(ipath); dir != "." {
+			name = path.Base(dir)
+		}
+	}
+	return name
+}
+
+// packageSelector returns the import path and selected name of expr if it
+// is a reference to a member of an imported package, such as
+// "time.Sleep".
+func packageSelector(imports map[string]string, x *ast.SelectorExpr) (ipath, sel string, ok bool) {
+	id, ok := x.X.(*ast.Ident)
+	// Identifiers that resolve to a local object shadow the import.
+	if !ok || id.Obj != nil {
+		return "", "", false
+	}
+	ipath, ok = imports[id.Name]
+	if !ok {
+		return "", "", false
+	}
+	return ipath, x.Sel.Name, true
+}
+
+// Flaky risk categories reported by flakyRisks.
+const (
+	flakyTime    = "time"
+	flakyNetwork = "network"
+	flakyRand    = "rand"
+)
+
+func isNetworkCall(ipath, sel string) bool {
+	switch ipath {
+	case "net":
+		return strings.HasPrefix(sel, "Dial") || strings.HasPrefix(sel, "Listen") ||
+			strings.HasPrefix(sel, "Lookup")
+	case "net/http":
+		switch sel {
+		case "Get", "Head", "Post", "PostForm", "DefaultClient",
+			"ListenAndServe", "ListenAndServeTLS", "Serve", "ServeTLS":
+			return true
+		}
+	}
+	return false
+}
+
+// flakyRisks returns the sorted reasons function d may be prone to flakiness:
+// sleeping ("time"), using the network ("network") or using the global
+// random number generator without seeding it ("rand").
+func flakyRisks(imports map[string]string, d *ast.FuncDecl) []string {
+	if d.Body == nil || len(imports) == 0 {
+		return nil
+	}
+	risks := make(map[string]bool)
+	usesRand := false
+	seeded := false
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		x, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		ipath, sel, ok := packageSelector(imports, x)
+		if !ok {
+			return true
+		}
+		switch ipath {
+		case "time":
+			if sel == "Sleep" {
+				risks[flakyTime] = true
+			}
+		case "net", "net/http":
+			if isNetworkCall(ipath, sel) {
+				risks[flakyNetwork] = true
+			}
+		case "math/rand", "math/rand/v2":
+			switch sel {
+			case "Seed", "New", "NewSource", "NewPCG", "NewChaCha8":
+				seeded = true
+			default:
+				usesRand = true
+			}
+		}
+		return true
+	})
+	if usesRand && !seeded {
+		risks[flakyRand] = true
+	}
+	if len(risks) == 0 {
+		return nil
+	}
+	a := make([]string, 0, len(risks))
+	for s := range risks {
+		a = append(a, s)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// isFileWrite reports if ipath.sel is a function that creates or writes a
+// file named by its first argument.
+func isFileWrite(ipath, sel string) bool {
+	switch ipath {
+	case "os":
+		switch sel {
+		case "Create", "WriteFile", "OpenFile", "Mkdir", "MkdirAll":
+			return true
+		}
+	case "io/ioutil":
+		return sel == "WriteFile"
+	}
+	return false
+}
+
+// isTempDirSource reports if the call returns a temporary directory or
+// file: t.TempDir(), os.TempDir(), os.MkdirTemp(), etc.
+func isTempDirSource(imports map[string]string, call *ast.CallExpr) bool {
+	x, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	if ipath, sel, ok := packageSelector(imports, x); ok {
+		switch ipath {
+		case "os":
+			return sel == "TempDir" || sel == "MkdirTemp" || sel == "CreateTemp"
+		case "io/ioutil":
+			return sel == "TempDir" || sel == "TempFile"
+		}
+		return false
+	}
+	// Method call such as t.TempDir() or b.TempDir()
+	return x.Sel.Name == "TempDir" && len(call.Args) == 0
+}
+
+// mentionsTempDir reports if expr contains a temporary directory source or
+// an identifier in temps.
+func mentionsTempDir(imports map[string]string, temps map[*ast.Object]bool, expr ast.Expr) bool {
+	found := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.CallExpr:
+			if isTempDirSource(imports, x) {
+				found = true
+			}
+		case *ast.Ident:
+			if x.Obj != nil && temps[x.Obj] {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// writesOutsideTempDir returns the position of the first call in function
+// d that creates or writes a file at a path that is not derived from a
+// temporary directory (such as t.TempDir()) and is not absolute, which may
+// pollute the working directory.
+func writesOutsideTempDir(imports map[string]string, d *ast.FuncDecl) (token.Pos, bool) {
+	if d.Body == nil || len(imports) == 0 {
+		return token.NoPos, false
+	}
+	// Variables assigned a temporary directory (or a path derived from one)
+	temps := make(map[*ast.Object]bool)
+	var pos token.Pos
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		if pos.IsValid() {
+			return false
+		}
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if len(x.Lhs) == len(x.Rhs) {
+				for i, lhs := range x.Lhs {
+					id, ok := lhs.(*ast.Ident)
+					if ok && id.Obj != nil && mentionsTempDir(imports, temps, x.Rhs[i]) {
+						temps[id.Obj] = true
+					}
+				}
+			}
+		case *ast.CallExpr:
+			sel, ok := x.Fun.(*ast.SelectorExpr)
+			if !ok || len(x.Args) == 0 {
+				break
+			}
+			ipath, name, ok := packageSelector(imports, sel)
+			if !ok || !isFileWrite(ipath, name) {
+				break
+			}
+			arg := x.Args[0]
+			if lit, ok := arg.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if s, err := strconv.Unquote(lit.Value); err == nil && filepath.IsAbs(s) {
+					break
+				}
+			}
+			if !mentionsTempDir(imports, temps, arg) {
+				pos = x.Pos()
+			}
+		}
+		return true
+	})
+	return pos, pos.IsValid()
+}
+
+// callsDeadline reports if d, or a function literal within it, calls the
+// Deadline method of a *testing.T parameter. Tests that do so adapt to the
+// -timeout flag so a runner should avoid imposing its own timeout.
+func callsDeadline(imports map[string]string, d *ast.FuncDecl) bool {
+	if d.Body == nil {
+		return false
+	}
+	testingName := testingImportName(imports)
+	if testingName == "" {
+		return false
+	}
+	params := testingParams(testingName, "T", d.Type)
+
+	found := false
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			for obj := range testingParams(testingName, "T", x.Type) {
+				params[obj] = true
+			}
+		case *ast.CallExpr:
+			if isParamSelector(params, x.Fun, "Deadline") {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// testingParams returns the objects of the parameters of ft that are of
+// type *testing.NAME, where testingName is the local name of the testing
+// package.
+func testingParams(testingName, typeName string, ft *ast.FuncType) map[*ast.Object]bool {
+	params := make(map[*ast.Object]bool)
+	if ft.Params == nil {
+		return params
+	}
+	for _, f := range ft.Params.List {
+		star, ok := f.Type.(*ast.StarExpr)
+		if !ok {
+			continue
+		}
+		sel, ok := star.X.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != typeName {
+			continue
+		}
+		if id, ok := sel.X.(*ast.Ident); !ok || id.Name != testingName {
+			continue
+		}
+		for _, id := range f.Names {
+			if id.Obj != nil {
+				params[id.Obj] = true
+			}
+		}
+	}
+	return params
+}
+
+// testingImportName returns the local name of the testing package. If it
+// is imported more than once the least name is returned so that the result
+// does not depend on the iteration order of imports.
+func testingImportName(imports map[string]string) string {
+	testingName := ""
+	for name, ipath := range imports {
+		if ipath == "testing" && (testingName == "" || name < testingName) {
+			testingName = name
+		}
+	}
+	return testingName
+}
+
+// isParamSelector reports if x is a selector of field or method sel of one
+// of params, such as "b.N".
+func isParamSelector(params map[*ast.Object]bool, x ast.Node, sel string) bool {
+	s, ok := x.(*ast.SelectorExpr)
+	if !ok || s.Sel.Name != sel {
+		return false
+	}
+	id, ok := s.X.(*ast.Ident)
+	return ok && id.Obj != nil && params[id.Obj]
+}
+
+// missingResetTimer reports if the benchmark d performs setup before its
+// loop over b.N without calling b.ResetTimer (or b.StopTimer and
+// b.StartTimer). To remain conservative only statements before the loop
+// that call a function, other than a method of b, are considered setup.
+// Benchmarks using b.Loop, which excludes setup itself, are not reported.
+func missingResetTimer(imports map[string]string, d *ast.FuncDecl) bool {
+	if d.Body == nil {
+		return false
+	}
+	testingName := testingImportName(imports)
+	if testingName == "" {
+		return false
+	}
+	params := testingParams(testingName, "B", d.Type)
+	if len(params) == 0 {
+		return false
+	}
+
+	timer := false
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			for _, name := range []string{"ResetTimer", "StopTimer", "StartTimer", "Loop"} {
+				if isParamSelector(params, call.Fun, name) {
+					timer = true
+				}
+			}
+		}
+		return !timer
+	})
+	if timer {
+		return false
+	}
+
+	setup := false
+	for _, stmt := range d.Body.List {
+		if loop, ok := stmt.(*ast.ForStmt); ok && loopsOverN(params, loop) {
+			return setup
+		}
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if sel, ok := x.Fun.(*ast.SelectorExpr); ok {
+					if id, ok := sel.X.(*ast.Ident); ok && id.Obj != nil && params[id.Obj] {
+						return true
+					}
+				}
+				setup = true
+			}
+			return !setup
+		})
+	}
+	return false
+}
+
+// loopsOverN reports if the condition of loop references b.N.
+func loopsOverN(params map[*ast.Object]bool, loop *ast.ForStmt) bool {
+	if loop.Cond == nil {
+		return false
+	}
+	found := false
+	ast.Inspect(loop.Cond, func(n ast.Node) bool {
+		if isParamSelector(params, n, "N") {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// Test frameworks reported by testFramework.
+const (
+	frameworkTestify    = "testify"
+	frameworkGotestTool = "gotest.tools"
+	frameworkGoConvey   = "goconvey"
+	frameworkGinkgo     = "ginkgo"
+	frameworkQuicktest  = "quicktest"
+	frameworkStdlib     = "testing"
+)
+
+// frameworkImports maps import path prefixes to the test framework they
+// belong to. The first matching entry wins so more specific frameworks
+// should be listed first.
+var frameworkImports = []struct {
+	prefix    string
+	framework string
+}{
+	{"github.com/stretchr/testify/", frameworkTestify},
+	{"gotest.tools/", frameworkGotestTool},
+	{"github.com/smartystreets/goconvey/", frameworkGoConvey},
+	{"github.com/onsi/ginkgo", frameworkGinkgo},
+	{"github.com/onsi/gomega", frameworkGinkgo},
+	{"github.com/frankban/quicktest", frameworkQuicktest},
+}
+
+// testFramework returns the assertion or test framework used by a file with
+// imports, or "testing" if only the standard library is used.
+func testFramework(imports map[string]string) string {
+	for _, fw := range frameworkImports {
+		for _, ipath := range imports {
+			if ipath == strings.TrimSuffix(fw.prefix, "/") || strings.HasPrefix(ipath, fw.prefix) {
+				return fw.framework
+			}
+		}
+	}
+	return frameworkStdlib
+}
+
+// packageVars returns the names of the package level variables declared by
+// files.
+func packageVars(files []*ast.File) map[string]bool {
+	vars := make(map[string]bool)
+	for _, af := range files {
+		if af == nil {
+			continue
+		}
+		for _, decl := range af.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				for _, id := range spec.(*ast.ValueSpec).Names {
+					if id.Name != "_" {
+						vars[id.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return vars
+}
+
+// assignedIdent returns the variable assigned to by expr: "x" for the
+// expressions x, x.f, x[i] and *x.
+func assignedIdent(expr ast.Expr) *ast.Ident {
+	for {
+		switch x := expr.(type) {
+		case *ast.Ident:
+			return x
+		case *ast.SelectorExpr:
+			expr = x.X
+		case *ast.IndexExpr:
+			expr = x.X
+		case *ast.StarExpr:
+			expr = x.X
+		case *ast.ParenExpr:
+			expr = x.X
+		default:
+			return nil
+		}
+	}
+}
+
+// packageVarWrites returns the sorted names of the package level variables
+// (see packageVars) that d assigns to. Such tests may depend on the order
+// in which tests are run and fail with -shuffle. Only variables declared in
+// the package's test files are considered and writes through pointers or
+// function calls are not detected.
+func packageVarWrites(af *ast.File, vars map[string]bool, d *ast.FuncDecl) []string {
+	if d.Body == nil || len(vars) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	check := func(expr ast.Expr) {
+		id := assignedIdent(expr)
+		if id == nil || !vars[id.Name] || seen[id.Name] {
+			return
+		}
+		// Unresolved identifiers are declared in another file. Resolved
+		// identifiers must refer to the file scope object and not a local
+		// variable that shadows it.
+		if id.Obj != nil && af.Scope.Lookup(id.Name) != id.Obj {
+			return
+		}
+		seen[id.Name] = true
+		names = append(names, id.Name)
+	}
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if x.Tok != token.DEFINE {
+				for _, lhs := range x.Lhs {
+					check(lhs)
+				}
+			}
+		case *ast.IncDecStmt:
+			check(x.X)
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// callsRunParallel reports if benchmark d calls b.RunParallel on its
+// *testing.B parameter or on that of a sub-benchmark run with b.Run.
+func callsRunParallel(imports map[string]string, d *ast.FuncDecl) bool {
+	testingName := testingImportName(imports)
+	if testingName == "" || d.Body == nil {
+		return false
+	}
+	params := testingParams(testingName, "B", d.Type)
+	found := false
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			for obj := range testingParams(testingName, "B", x.Type) {
+				params[obj] = true
+			}
+		case *ast.CallExpr:
+			if isParamSelector(params, x.Fun, "RunParallel") {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// callsParallel reports if test d calls t.Parallel, where t is its
+// *testing.T parameter, as a top-level statement of its body.
+func callsParallel(imports map[string]string, d *ast.FuncDecl) bool {
+	testingName := testingImportName(imports)
+	if testingName == "" || d.Body == nil {
+		return false
+	}
+	params := testingParams(testingName, "T", d.Type)
+	if len(params) == 0 {
+		return false
+	}
+	for _, stmt := range d.Body.List {
+		es, ok := stmt.(*ast.ExprStmt)
+		if !ok {
+			continue
+		}
+		if call, ok := es.X.(*ast.CallExpr); ok && len(call.Args) == 0 &&
+			isParamSelector(params, call.Fun, "Parallel") {
+			return true
+		}
+	}
+	return false
+}
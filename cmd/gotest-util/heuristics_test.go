@@ -0,0 +1,127 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// parseTestFuncs parses the test file src, which must not include a package
+// clause or imports other than "testing", and returns its functions by
+// name along with the file's imports.
+func parseTestFuncs(t *testing.T, src string) (map[string]*ast.FuncDecl, map[string]string) {
+	t.Helper()
+	src = "package p\n\nimport (\n\t\"testing\"\n\t\"time\"\n)\n\nvar _ time.Duration\n\n" + src
+	af, err := parser.ParseFile(token.NewFileSet(), "p_test.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := make(map[string]*ast.FuncDecl)
+	for _, decl := range af.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok {
+			funcs[d.Name.Name] = d
+		}
+	}
+	return funcs, importNames(af)
+}
+
+func TestCallsDeadline(t *testing.T) {
+	funcs, imports := parseTestFuncs(t, `
+func TestDeadline(t *testing.T) {
+	if d, ok := t.Deadline(); ok {
+		_ = d
+	}
+}
+
+func TestDeadlineSubtest(t *testing.T) {
+	t.Run("sub", func(st *testing.T) {
+		st.Deadline()
+	})
+}
+
+func TestNoDeadline(t *testing.T) {
+	time.Sleep(time.Millisecond)
+}
+
+func TestOtherDeadline(t *testing.T) {
+	var x interface{ Deadline() (time.Time, bool) }
+	x.Deadline()
+}
+`)
+	tests := map[string]bool{
+		"TestDeadline":        true,
+		"TestDeadlineSubtest": true,
+		"TestNoDeadline":      false,
+		"TestOtherDeadline":   false,
+	}
+	for name, want := range tests {
+		if got := callsDeadline(imports, funcs[name]); got != want {
+			t.Errorf("callsDeadline(%s) = %t; want: %t", name, got, want)
+		}
+	}
+}
+
+func TestMissingResetTimer(t *testing.T) {
+	funcs, imports := parseTestFuncs(t, `
+func setup() []int { return make([]int, 1e6) }
+
+func BenchmarkMissing(b *testing.B) {
+	data := setup()
+	for i := 0; i < b.N; i++ {
+		_ = data[i%len(data)]
+	}
+}
+
+func BenchmarkReset(b *testing.B) {
+	data := setup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = data[i%len(data)]
+	}
+}
+
+func BenchmarkStopStart(b *testing.B) {
+	b.StopTimer()
+	data := setup()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_ = data[i%len(data)]
+	}
+}
+
+func BenchmarkTrivialSetup(b *testing.B) {
+	n := 0
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		n++
+	}
+}
+
+func BenchmarkSetupAfterLoop(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+	}
+	setup()
+}
+
+func BenchmarkLoop(b *testing.B) {
+	data := setup()
+	for b.Loop() {
+		_ = data
+	}
+}
+`)
+	tests := map[string]bool{
+		"BenchmarkMissing":        true,
+		"BenchmarkReset":          false,
+		"BenchmarkStopStart":      false,
+		"BenchmarkTrivialSetup":   false,
+		"BenchmarkSetupAfterLoop": false,
+		"BenchmarkLoop":           false,
+	}
+	for name, want := range tests {
+		if got := missingResetTimer(imports, funcs[name]); got != want {
+			t.Errorf("missingResetTimer(%s) = %t; want: %t", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An IgnorePattern matches the names of tests to ignore. Patterns are
+// globs (see path.Match), such as "TestSlow*", or regular expressions if
+// prefixed with "re:", such as "re:^Test.*Integration$".
+type IgnorePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// ParseIgnorePattern parses the ignore pattern s.
+func ParseIgnorePattern(s string) (*IgnorePattern, error) {
+	if expr := strings.TrimPrefix(s, "re:"); expr != s {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return &IgnorePattern{re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", s, err)
+	}
+	return &IgnorePattern{glob: s}, nil
+}
+
+// Match reports if the test name matches p.
+func (p *IgnorePattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// ReadIgnoreFile reads the ignore patterns of the file name, which has one
+// pattern per line. Blank lines and lines starting with '#' are ignored.
+func ReadIgnoreFile(name string) ([]*IgnorePattern, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []*IgnorePattern
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := ParseIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, lineno, err)
+		}
+		patterns = append(patterns, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// filterIgnored removes the defs whose name matches any of patterns and
+// adds their names to ignored.
+func filterIgnored(defs []*FuncDefinition, patterns []*IgnorePattern, ignored *[]string) []*FuncDefinition {
+	if len(patterns) == 0 {
+		return defs
+	}
+	var kept []*FuncDefinition
+	for _, d := range defs {
+		if matchAny(patterns, d.Name) {
+			*ignored = append(*ignored, d.Name)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	sort.Strings(*ignored)
+	return kept
+}
+
+// matchAny reports if name matches any of patterns.
+func matchAny(patterns []*IgnorePattern, name string) bool {
+	for _, p := range patterns {
+		if p.Match(name) {
+			return true
+		}
+	}
+	return false
+}
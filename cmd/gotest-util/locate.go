@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"sort"
+
+	util "golang.org/x/tools/go/buildutil"
+)
+
+// locateConfigs are the GOOS/GOARCH configurations searched by Locate in
+// addition to that of the build context.
+var locateConfigs = []struct{ GOOS, GOARCH string }{
+	{"linux", "amd64"},
+	{"linux", "arm64"},
+	{"darwin", "amd64"},
+	{"darwin", "arm64"},
+	{"windows", "amd64"},
+	{"freebsd", "amd64"},
+}
+
+// A LocateResult lists the declarations of a function in the test files
+// included by a GOOS/GOARCH configuration.
+type LocateResult struct {
+	GOOS      string    `json:"goos"`
+	GOARCH    string    `json:"goarch"`
+	Positions []FuncRef `json:"positions"`
+}
+
+// Locate returns the declarations of the test function name in the test
+// files of the package in dir for the configuration of ctxt and a set of
+// common GOOS/GOARCH configurations (see locateConfigs). This finds the
+// platform specific variants of a test, such as TestOpen being declared in
+// both "open_linux_test.go" and "open_windows_test.go". Configurations
+// with no declarations are omitted.
+func Locate(ctxt *build.Context, dir, name string) ([]LocateResult, error) {
+	configs := append([]struct{ GOOS, GOARCH string }{{ctxt.GOOS, ctxt.GOARCH}},
+		locateConfigs...)
+
+	fset := token.NewFileSet()
+	parsed := make(map[string][]FuncRef) // filename => declarations of name
+	seen := make(map[[2]string]bool)
+	var results []LocateResult
+	for _, cfg := range configs {
+		if seen[[2]string{cfg.GOOS, cfg.GOARCH}] {
+			continue
+		}
+		seen[[2]string{cfg.GOOS, cfg.GOARCH}] = true
+
+		c := CopyContext(ctxt)
+		c.GOOS = cfg.GOOS
+		c.GOARCH = cfg.GOARCH
+		pkg, err := c.ImportDir(dir, 0)
+		if err != nil {
+			var noGo *build.NoGoError
+			if !errors.As(err, &noGo) || pkg == nil {
+				return nil, err
+			}
+		}
+
+		res := LocateResult{GOOS: cfg.GOOS, GOARCH: cfg.GOARCH}
+		for _, fname := range append(pkg.TestGoFiles, pkg.XTestGoFiles...) {
+			filename := util.JoinPath(c, dir, fname)
+			refs, ok := parsed[filename]
+			if !ok {
+				af, err := util.ParseFile(fset, c, nil, dir, fname, parser.SkipObjectResolution)
+				if af == nil {
+					return nil, err
+				}
+				for _, decl := range af.Decls {
+					d, ok := decl.(*ast.FuncDecl)
+					if ok && d.Recv == nil && d.Name.Name == name {
+						pos := fset.Position(d.Pos())
+						refs = append(refs, FuncRef{
+							Name:     name,
+							Filename: pos.Filename,
+							Line:     pos.Line,
+						})
+					}
+				}
+				parsed[filename] = refs
+			}
+			res.Positions = append(res.Positions, refs...)
+		}
+		if len(res.Positions) == 0 {
+			continue
+		}
+		sort.Slice(res.Positions, func(i, j int) bool {
+			p1, p2 := res.Positions[i], res.Positions[j]
+			if p1.Filename != p2.Filename {
+				return p1.Filename < p2.Filename
+			}
+			return p1.Line < p2.Line
+		})
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -1,24 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"go/ast"
 	"go/build"
+	"go/doc"
 	"go/parser"
+	"go/printer"
+	"go/scanner"
 	"go/token"
+	"go/types"
 	"io"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/charlievieth/buildutil"
 	"github.com/charlievieth/buildutil/contextutil"
@@ -34,6 +48,13 @@ type TestVisitor struct {
 	Benchmarks []*ast.FuncDecl
 	Examples   []*ast.FuncDecl
 	Fuzz       []*ast.FuncDecl
+
+	// TestMain is the package's TestMain function, if any, which is not
+	// a test (see isTestMain).
+	TestMain *ast.FuncDecl
+
+	// Kinds, if not empty, are the kinds of functions to collect.
+	Kinds map[int]bool
 }
 
 func (v *TestVisitor) AddTest(d *ast.FuncDecl) {
@@ -60,18 +81,95 @@ func (v *TestVisitor) AddFuzz(d *ast.FuncDecl) {
 	v.mu.Unlock()
 }
 
+// Kinds of test functions.
+const (
+	kindNone = iota
+	kindTest
+	kindBenchmark
+	kindExample
+	kindFuzz
+)
+
+// kindNames maps the names of the kinds of test functions, as accepted by
+// the --kind flag, to their kind.
+var kindNames = map[string]int{
+	"test":      kindTest,
+	"benchmark": kindBenchmark,
+	"example":   kindExample,
+	"fuzz":      kindFuzz,
+}
+
+// parseKinds returns the set of kinds named by names (see kindNames).
+func parseKinds(names []string) (map[int]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	kinds := make(map[int]bool, len(names))
+	for _, name := range names {
+		kind, ok := kindNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid kind: %q (must be one of: test, benchmark, example or fuzz)", name)
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// testFuncKind returns the kind of test function named name.
+func testFuncKind(name string) int {
+	switch {
+	case strings.HasPrefix(name, "Test"):
+		return kindTest
+	case strings.HasPrefix(name, "Benchmark"):
+		return kindBenchmark
+	case strings.HasPrefix(name, "Example"):
+		return kindExample
+	case strings.HasPrefix(name, "Fuzz"):
+		return kindFuzz
+	}
+	return kindNone
+}
+
+// isTestMain reports if d is a TestMain function, which go test calls
+// instead of running the tests directly: "func TestMain(m *testing.M)".
+// A TestMain with any other signature, such as a *testing.T parameter, is
+// an ordinary test.
+func isTestMain(d *ast.FuncDecl) bool {
+	if d.Name.Name != "TestMain" || d.Recv != nil || d.Type.Params == nil ||
+		len(d.Type.Params.List) != 1 || len(d.Type.Params.List[0].Names) > 1 {
+		return false
+	}
+	star, ok := d.Type.Params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "M"
+}
+
 func (v *TestVisitor) Visit(node ast.Node) (w ast.Visitor) {
 	if d, ok := node.(*ast.FuncDecl); ok && d != nil && d.Name != nil {
-		switch name := d.Name.Name; {
-		case strings.HasPrefix(name, "Test"):
+		if isTestMain(d) {
+			v.mu.Lock()
+			v.TestMain = d
+			v.mu.Unlock()
+			return nil
+		}
+		kind := testFuncKind(d.Name.Name)
+		if len(v.Kinds) != 0 && !v.Kinds[kind] {
+			return nil
+		}
+		switch kind {
+		case kindTest:
 			v.AddTest(d)
-		case strings.HasPrefix(name, "Benchmark"):
+		case kindBenchmark:
 			v.AddBenchmark(d)
-		case strings.HasPrefix(name, "Example"):
+		case kindExample:
 			v.AddExample(d)
-		case strings.HasPrefix(name, "Fuzz"):
+		case kindFuzz:
 			v.AddFuzz(d)
 		}
+		return nil // function declarations are not nested
 	}
 	return v
 }
@@ -80,10 +178,200 @@ type FuncDefinition struct {
 	Name     string `json:"name"`
 	Filename string `json:"filename"`
 	Line     int    `json:"line"`
+	EndLine  int    `json:"end_line"` // line of the closing brace
 	Doc      string `json:"comment,omitempty"`
+
+	// Signature is the declaration of the function without its body,
+	// such as "func FuzzFoo(f *testing.F)" (see ListOptions.Signatures).
+	Signature string `json:"signature,omitempty"`
+
+	// Recv is the receiver type of the function, if it is a method.
+	Recv string `json:"recv,omitempty"`
+
+	// Parallel is set for tests that call t.Parallel and benchmarks that
+	// call b.RunParallel.
+	Parallel bool `json:"parallel,omitempty"`
+
+	// CorpusFiles is the number of seed corpus files of a fuzz target in
+	// the package's testdata/fuzz/NAME directory.
+	CorpusFiles int `json:"corpus_files,omitempty"`
+
+	// RequiredTags are the custom build tags that must be passed to
+	// "go test -tags" to build the function's file (see requiredBuildTags).
+	RequiredTags []string `json:"required_tags,omitempty"`
+
+	// Subtests are the names of the subtests run by the test with t.Run
+	// (see findSubtests).
+	Subtests []string `json:"subtests,omitempty"`
+
+	// GoTestNames are the full names of the Subtests, in the same order,
+	// exactly as they are reported by go test: rewritten and with
+	// duplicates disambiguated by the testing package, such as
+	// "TestFoo/a_case#01" (see nameSubtests). They can be passed verbatim
+	// to "go test -run".
+	GoTestNames []string `json:"go_test_names,omitempty"`
+
+	// FlakyRisk is an advisory list of the reasons the function may be
+	// prone to flakiness (see flakyRisks).
+	FlakyRisk []string `json:"flaky_risk,omitempty"`
+
+	// WritesCWD is an advisory indication that the function writes a
+	// file outside of a temporary directory, possibly the working
+	// directory, at line WritesCWDLine (see writesOutsideTempDir).
+	WritesCWD     bool `json:"writes_cwd,omitempty"`
+	WritesCWDLine int  `json:"writes_cwd_line,omitempty"`
+
+	// DeadlineAware is an advisory indication that the test calls
+	// t.Deadline and adapts to the test timeout (see callsDeadline).
+	DeadlineAware bool `json:"deadline_aware,omitempty"`
+
+	// WritesPackageVars is an advisory list of the package level variables
+	// the function assigns to, which may make it depend on the order that
+	// tests are run (see packageVarWrites).
+	WritesPackageVars []string `json:"writes_package_vars,omitempty"`
+
+	// Framework is the test framework (such as "testify") used by the
+	// function's file based on its imports (see testFramework).
+	Framework string `json:"framework,omitempty"`
+
+	// HasOutput reports if the example has an "Output:" comment and is
+	// run by go test. Examples without one are only compiled, which is
+	// reported by CompileOnly (the inverse of HasOutput). Both are only
+	// set for examples.
+	HasOutput   bool `json:"has_output,omitempty"`
+	CompileOnly bool `json:"compile_only,omitempty"`
+
+	// MissingResetTimer is an advisory indication that the benchmark
+	// performs setup that is not excluded from its measurement (see
+	// missingResetTimer).
+	MissingResetTimer bool `json:"missing_reset_timer,omitempty"`
+
+	// RelatedTest is the test of an example's subject (see exampleSubject).
+	RelatedTest *FuncRef `json:"related_test,omitempty"`
+}
+
+// A FuncRef refers to a function by name and position.
+type FuncRef struct {
+	Name     string `json:"name"`
+	Filename string `json:"filename"`
+	Line     int    `json:"line"`
+}
+
+// FileLines are the first and last lines of the functions in a file.
+type FileLines struct {
+	FirstTestLine int `json:"first_test_line"`
+	LastTestLine  int `json:"last_test_line"`
+}
+
+// fileLines returns the FileLines of the files of defs.
+func fileLines(defs ...[]*FuncDefinition) map[string]*FileLines {
+	var m map[string]*FileLines
+	for _, a := range defs {
+		for _, def := range a {
+			if m == nil {
+				m = make(map[string]*FileLines)
+			}
+			fl := m[def.Filename]
+			if fl == nil {
+				m[def.Filename] = &FileLines{def.Line, def.Line}
+				continue
+			}
+			if def.Line < fl.FirstTestLine {
+				fl.FirstTestLine = def.Line
+			}
+			if def.Line > fl.LastTestLine {
+				fl.LastTestLine = def.Line
+			}
+		}
+	}
+	return m
+}
+
+// exampleOutputs returns the set of examples in files that have an output
+// comment (including an empty one) and are thus run by go test.
+func exampleOutputs(files []*ast.File) map[string]bool {
+	var afs []*ast.File
+	for _, af := range files {
+		if af != nil {
+			afs = append(afs, af)
+		}
+	}
+	m := make(map[string]bool)
+	for _, ex := range doc.Examples(afs...) {
+		if ex.Output != "" || ex.EmptyOutput {
+			m["Example"+ex.Name] = true
+		}
+	}
+	return m
+}
+
+// exampleSubject returns the name of the symbol documented by the example
+// named name: "ExampleFoo" => "Foo", "ExampleT_Method_suffix" => "T_Method".
+// An empty string is returned for package examples.
+func exampleSubject(name string) string {
+	sym := strings.TrimPrefix(name, "Example")
+	if sym == "" || sym[0] == '_' {
+		return "" // package example
+	}
+	// Strip the suffix, which must start with a lower-case letter.
+	if i := strings.LastIndexByte(sym, '_'); i != -1 {
+		r, _ := utf8.DecodeRuneInString(sym[i+1:])
+		if unicode.IsLower(r) {
+			sym = sym[:i]
+		}
+	}
+	return sym
+}
+
+// linkExamples sets the RelatedTest of each example whose subject has a
+// test named "Test" + subject.
+func linkExamples(examples, tests []*FuncDefinition) {
+	if len(examples) == 0 || len(tests) == 0 {
+		return
+	}
+	byName := make(map[string]*FuncDefinition, len(tests))
+	for _, t := range tests {
+		byName[t.Name] = t
+	}
+	for _, ex := range examples {
+		sym := exampleSubject(ex.Name)
+		if sym == "" {
+			continue
+		}
+		if t := byName["Test"+sym]; t != nil {
+			ex.RelatedTest = &FuncRef{Name: t.Name, Filename: t.Filename, Line: t.Line}
+		}
+	}
+}
+
+// funcSignature returns the declaration of d without its body or doc
+// comment.
+func funcSignature(fset *token.FileSet, d *ast.FuncDecl) string {
+	decl := *d
+	decl.Doc = nil
+	decl.Body = nil
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, &decl); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// funcRecv returns the receiver type of d, if it is a method.
+func funcRecv(d *ast.FuncDecl) string {
+	if d.Recv != nil && len(d.Recv.List) == 1 {
+		return types.ExprString(d.Recv.List[0].Type)
+	}
+	return ""
 }
 
-func declsToDefinitions(fset *token.FileSet, decls []*ast.FuncDecl) []*FuncDefinition {
+// declsToDefinitions converts decls to a list of FuncDefinitions sorted by
+// name, file name and line. The order of decls, which are collected
+// concurrently, does not matter. If annotate is not nil it is called with
+// each FuncDecl and its FuncDefinition.
+func declsToDefinitions(fset *token.FileSet, decls []*ast.FuncDecl,
+	annotate func(*ast.FuncDecl, *FuncDefinition)) []*FuncDefinition {
+
 	if len(decls) == 0 {
 		return nil
 	}
@@ -94,563 +382,3599 @@ func declsToDefinitions(fset *token.FileSet, decls []*ast.FuncDecl) []*FuncDefin
 			Name:     d.Name.Name,
 			Filename: pos.Filename,
 			Line:     pos.Line,
+			EndLine:  fset.Position(d.End()).Line,
 			Doc:      d.Doc.Text(),
 		}
+		defs[i].Recv = funcRecv(d)
+		if annotate != nil {
+			annotate(d, defs[i])
+		}
 	}
 	sort.Slice(defs, func(i, j int) bool {
-		return defs[i].Name < defs[j].Name
+		if defs[i].Name != defs[j].Name {
+			return defs[i].Name < defs[j].Name
+		}
+		if defs[i].Filename != defs[j].Filename {
+			return defs[i].Filename < defs[j].Filename
+		}
+		return defs[i].Line < defs[j].Line
 	})
 	return defs
 }
 
 type ListTestsResponse struct {
-	PkgName    string            `json:"pkg_name"`
-	PkgRoot    string            `json:"pkg_root"`
+	PkgName    string `json:"pkg_name"`
+	PkgRoot    string `json:"pkg_root"`
+	ImportPath string `json:"import_path,omitempty"`
+	Goroot     bool   `json:"goroot,omitempty"` // package is in GOROOT
+
+	// InMainModule is true if the package belongs to the main module and
+	// not to a dependency (such as a module cache or vendor directory).
+	InMainModule bool `json:"in_main_module"`
+
+	// HasTestMain is true if the package has a TestMain function, which
+	// is excluded from Tests. Since go test runs the tests through it,
+	// running a single test still performs its package-wide setup.
+	HasTestMain bool `json:"has_test_main"`
+
+	// GoDirective is the version of the go directive of the package's
+	// go.mod file, which determines the language version of the package.
+	GoDirective string `json:"go_directive,omitempty"`
+
 	GoEnv      *GoEnv            `json:"go_env,omitempty"`
 	Tests      []*FuncDefinition `json:"tests,omitempty"`
 	Benchmarks []*FuncDefinition `json:"benchmarks,omitempty"`
 	Examples   []*FuncDefinition `json:"examples,omitempty"`
 	Fuzz       []*FuncDefinition `json:"fuzz,omitempty"`
-}
-
-// TODO: list funcs and methods as well
-func ListTests(ctxt *build.Context, dir string) (*ListTestsResponse, error) {
-	pkg, err := ctxt.ImportDir(dir, 0)
-	if err != nil {
-		return nil, err
-	}
 
-	// TODO: log the error?
-	pkgRoot, _ := contextutil.FindProjectRoot(ctxt, dir)
-	if pkgRoot == "" {
-		pkgRoot = filepath.Clean(dir)
-	}
-
-	names := append(pkg.TestGoFiles, pkg.XTestGoFiles...)
-	if len(names) == 0 {
-		return &ListTestsResponse{PkgName: pkg.Name, PkgRoot: pkgRoot}, nil
-	}
+	// Aliases maps each retained test file to the names collapsed into it
+	// (see ListOptions.ReportAliases).
+	Aliases map[string][]string `json:"aliases,omitempty"`
+
+	// TestBinaryName is the escaped name used for the package's cached
+	// test binary (see escapePath).
+	TestBinaryName string `json:"test_binary_name,omitempty"`
+
+	// Constraints maps each constrained test file to its normalized
+	// build constraint expression (see FileConstraint).
+	Constraints map[string]string `json:"constraints,omitempty"`
+
+	// Overlaid maps each parsed test file to whether its content was read
+	// from the overlay instead of disk (see ListOptions.OverlayTracker).
+	Overlaid map[string]bool `json:"overlaid,omitempty"`
+
+	// PackageClauses maps the name of each Go file to its declared package
+	// name if the files disagree on the package name, in which case the
+	// response is returned with a PackageClauseError.
+	PackageClauses map[string]string `json:"package_clauses,omitempty"`
+
+	// RequiredTags are the build tags, including any GOOS and GOARCH,
+	// referenced by the build constraints of the parsed test files. A
+	// test file is only visible if its constraint is satisfied by the
+	// active tags.
+	RequiredTags []string `json:"required_tags,omitempty"`
+
+	// ArchConstraints maps each parsed test file whose build constraint
+	// (including its file name) depends on the architecture to the GOARCH
+	// values it can be built for.
+	ArchConstraints map[string][]string `json:"arch_constraints,omitempty"`
+
+	// TestOnlyImports are the imports used by the package's test files
+	// but not by its non-test files.
+	TestOnlyImports []string `json:"test_only_imports,omitempty"`
+
+	// ContextExcludedAllTests is a warning that the directory contains
+	// test files but the build context, which uses BuildTags, excluded
+	// all of them.
+	ContextExcludedAllTests bool     `json:"context_excluded_all_tests,omitempty"`
+	BuildTags               []string `json:"build_tags,omitempty"`
+
+	// BuildID identifies the inputs used to build the package's test
+	// binary (see PackageBuildID).
+	BuildID string `json:"build_id,omitempty"`
+
+	// Buildable reports if the package's test binary compiles and
+	// BuildErrors are the compiler's diagnostics if it does not.
+	Buildable   *bool    `json:"buildable,omitempty"`
+	BuildErrors []string `json:"build_errors,omitempty"`
+
+	// FileLines maps each test file to the lines of its first and last
+	// test, benchmark, example or fuzz target.
+	FileLines map[string]*FileLines `json:"file_lines,omitempty"`
+
+	// Ignored are the names of the functions excluded by the Ignore
+	// patterns of the ListOptions.
+	Ignored []string `json:"ignored,omitempty"`
+
+	// ParseErrors are the errors encountered parsing the test files.
+	// The tests of files with errors are still reported if the file
+	// could be partially parsed.
+	ParseErrors []FileError `json:"parse_errors,omitempty"`
+
+	// Closures are the non-subtest function literals with a *testing.T
+	// parameter. They are not runnable tests.
+	Closures []*Closure `json:"closures,omitempty"`
+}
 
-	errs := make([]error, len(names))
-	fset := token.NewFileSet()
-	v := new(TestVisitor)
-	wg := new(sync.WaitGroup)
+// A FileError is an error in a file. The Line and Column are set if the
+// position of the error is known.
+type FileError struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Message  string `json:"message"`
+}
 
-	for i, name := range names {
-		wg.Add(1)
-		go func(i int, name string) {
-			defer wg.Done()
-			af, err := util.ParseFile(fset, ctxt, nil, dir, name,
-				parser.ParseComments)
-			if err != nil {
-				errs[i] = err
-			} else {
-				ast.Walk(v, af)
+// fileErrors converts err, which may be a scanner.ErrorList, into
+// FileErrors for filename.
+func fileErrors(filename string, err error) []FileError {
+	var list scanner.ErrorList
+	if errors.As(err, &list) && len(list) != 0 {
+		a := make([]FileError, len(list))
+		for i, e := range list {
+			a[i] = FileError{
+				Filename: filename,
+				Line:     e.Pos.Line,
+				Column:   e.Pos.Column,
+				Message:  e.Msg,
 			}
-		}(i, name)
+		}
+		return a
 	}
-	wg.Wait()
+	return []FileError{{Filename: filename, Message: err.Error()}}
+}
 
-	for _, err := range errs {
-		if err != nil {
-			return nil, err
+func hasTestFiles(names []string) bool {
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			return true
 		}
 	}
+	return false
+}
 
-	res := &ListTestsResponse{
-		PkgName:    pkg.Name,
-		PkgRoot:    pkgRoot,
-		GoEnv:      DiffGoEnv(&build.Default, ctxt),
-		Tests:      declsToDefinitions(fset, v.Tests),
-		Benchmarks: declsToDefinitions(fset, v.Benchmarks),
-		Examples:   declsToDefinitions(fset, v.Examples),
-		Fuzz:       declsToDefinitions(fset, v.Fuzz),
+// HasFunc reports if r contains a test, benchmark, example or fuzz target
+// named name.
+func (r *ListTestsResponse) HasFunc(name string) bool {
+	for _, defs := range [][]*FuncDefinition{r.Tests, r.Benchmarks, r.Examples, r.Fuzz} {
+		for _, d := range defs {
+			if d.Name == name {
+				return true
+			}
+		}
 	}
-	return res, nil
+	return false
 }
 
-type NoContainingFunctionError struct {
-	Filename string `json:"filename"`
-	Line     int    `json:"line"`
-	Column   int    `json:"column"`
-}
+// ListOptions configures ListTests.
+type ListOptions struct {
+	// DeduplicateFiles collapses test files that resolve to the same
+	// underlying file (symlinks, hard links) or the same overlay entry so
+	// that their tests are only reported once.
+	DeduplicateFiles bool
 
-func (e *NoContainingFunctionError) Error() string {
-	return fmt.Sprintf("no containing function at: %s:%d:%d",
-		e.Filename, e.Line, e.Column)
-}
+	// ReportAliases reports the names collapsed by DeduplicateFiles in the
+	// Aliases field of the response.
+	ReportAliases bool
 
-type FuncVisitor struct {
-	Pos token.Pos
-	Fn  *ast.FuncDecl
+	// IncludeBinaryNames sets the TestBinaryName of the response.
+	IncludeBinaryNames bool
+
+	// Subtests sets the Subtests of each test.
+	Subtests bool
+
+	// GoTestNames sets the GoTestNames, and Subtests, of each test.
+	GoTestNames bool
+
+	// SortSubtests is the order of the Subtests of each test: "position"
+	// (the default) for the order they are declared in, which is the
+	// order they are run in, or "name" (see sortSubtests).
+	SortSubtests string
+
+	// Signatures sets the Signature of each function.
+	Signatures bool
+
+	// FlakyHeuristics sets the FlakyRisk of each FuncDefinition.
+	FlakyHeuristics bool
+
+	// IncludeConstraints sets the Constraints of the response.
+	IncludeConstraints bool
+
+	// HermeticityCheck sets the WritesCWD of each FuncDefinition.
+	HermeticityCheck bool
+
+	// DeadlineCheck sets the DeadlineAware of each FuncDefinition.
+	DeadlineCheck bool
+
+	// OrderDeps sets the WritesPackageVars of each FuncDefinition.
+	OrderDeps bool
+
+	// DetectFramework sets the Framework of each FuncDefinition.
+	DetectFramework bool
+
+	// BenchmarkTimerCheck sets the MissingResetTimer of each benchmark.
+	BenchmarkTimerCheck bool
+
+	// TestOnlyImports sets the TestOnlyImports of the response.
+	TestOnlyImports bool
+
+	// IncludeBuildID sets the BuildID of the response.
+	IncludeBuildID bool
+
+	// LinkExamples sets the RelatedTest of examples.
+	LinkExamples bool
+
+	// NoEnv omits the GoEnv from the response.
+	NoEnv bool
+
+	// Closures sets the Closures of the response.
+	Closures bool
+
+	// DocTags limits the response to functions whose doc comment contains
+	// any of the tags (all of them if DocTagsAll is set). A tag matches a
+	// whitespace separated word of the comment, such as "@smoke".
+	DocTags    []string
+	DocTagsAll bool
+
+	// Kinds, if not empty, limits the functions listed to those of the
+	// named kinds: "test", "benchmark", "example" or "fuzz".
+	Kinds []string
+
+	// OverlayTracker, if not nil, is used to report which test files were
+	// read from the overlay of the Context (see OverlayContextTracker).
+	OverlayTracker *OverlayTracker
+
+	// Ignore removes the functions matching any of the patterns from the
+	// response and lists them in its Ignored field.
+	Ignore []*IgnorePattern
+
+	// BuildCheck sets the Buildable and BuildErrors of the response. This
+	// compiles the package's tests and is much slower than listing them.
+	BuildCheck bool
 }
 
-func (v *FuncVisitor) Visit(node ast.Node) (w ast.Visitor) {
-	if v.Fn != nil {
-		return nil
+// hasDocTags reports if the doc comment of d contains any (or all, if all
+// is true) of tags. Note that comment directives like "//nolint" are not
+// part of the doc comment text and cannot be matched.
+func hasDocTags(d *ast.FuncDecl, tags []string, all bool) bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Fields(d.Doc.Text()) {
+		words[w] = true
 	}
-	if d, ok := node.(*ast.FuncDecl); ok && d != nil {
-		if d.Pos() <= v.Pos && v.Pos <= d.End() {
-			v.Fn = d
-			return nil
+	for _, tag := range tags {
+		if words[tag] != all {
+			return !all
 		}
 	}
-	return v
+	return all
 }
 
-// TODO: use `findcall -name NAME *.go` to find references
-// where findcall is "golang.org/x/tools/go/analysis/passes/findcall/cmd/findcall"
-func ContainingFunction(filename string, src interface{}, line, column int) (string, error) {
-	fset := token.NewFileSet()
-	af, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
-	if err != nil && af == nil {
-		return "", err
-	}
-
-	file := fset.File(af.Pos())
-	if file == nil {
-		return "", errors.New("ast: no pos for file")
-	}
-	if n := file.LineCount(); line < 1 || line > n {
-		return "", fmt.Errorf("ast: invalid line number %d (should be between 1 and %d)", line, n)
+// filterDocTags returns the decls matching opts.DocTags.
+func filterDocTags(decls []*ast.FuncDecl, opts *ListOptions) []*ast.FuncDecl {
+	if len(opts.DocTags) == 0 {
+		return decls
 	}
-	pos := file.LineStart(line)
-	if !pos.IsValid() {
-		return "", fmt.Errorf("ast: invalid pos for line: %d", line)
-	}
-
-	// Fast check
-	for _, node := range af.Decls {
-		if d, ok := node.(*ast.FuncDecl); ok && d != nil {
-			if d.Pos() <= pos && pos <= d.End() {
-				if d.Name != nil {
-					return d.Name.Name, nil
-				}
-			}
+	var a []*ast.FuncDecl
+	for _, d := range decls {
+		if hasDocTags(d, opts.DocTags, opts.DocTagsAll) {
+			a = append(a, d)
 		}
 	}
+	return a
+}
 
-	v := FuncVisitor{Pos: pos}
-	ast.Walk(&v, af)
-
-	if v.Fn != nil && v.Fn.Name != nil {
-		return v.Fn.Name.Name, nil
+// pkgImportPath returns the import path of pkg, which for packages
+// imported by directory is found using the go.mod file of its module.
+// The import paths of standard library packages are set by go/build.
+func pkgImportPath(pkg *build.Package) string {
+	if pkg.ImportPath != "" && pkg.ImportPath != "." {
+		return pkg.ImportPath
 	}
-	return "", &NoContainingFunctionError{filename, line, column}
+	ipath, _ := moduleImportPath(pkg.Dir)
+	return ipath
 }
 
-type TestConfig struct {
-	Verbose bool
-	Short   bool
-	Race    bool
+// packageRoot returns the root of the project containing dir (see
+// contextutil.FindProjectRoot). If there is none, such as for a GOPATH
+// package without a go.mod file or VCS directory, the GOPATH/src directory
+// containing dir is returned and otherwise dir itself.
+func packageRoot(ctxt *build.Context, dir string) string {
+	// FindProjectRoot returns dir with an error if no root was found.
+	// TODO: log other errors?
+	if root, err := contextutil.FindProjectRoot(ctxt, dir); err == nil {
+		return root
+	}
+	if src := gopathSrcDir(ctxt, dir); src != "" {
+		return src
+	}
+	return filepath.Clean(dir)
 }
 
-type Event struct {
-	Time    *time.Time `json:",omitempty"`
-	Action  string
-	Package string   `json:",omitempty"`
-	Test    string   `json:",omitempty"`
-	Elapsed *float64 `json:",omitempty"`
-	Output  *string  `json:",omitempty"`
+// gopathSrcDir returns the "src" directory of the GOPATH element that
+// contains dir or an empty string if dir is not in the GOPATH.
+func gopathSrcDir(ctxt *build.Context, dir string) string {
+	for _, p := range filepath.SplitList(ctxt.GOPATH) {
+		if p == "" || !filepath.IsAbs(p) {
+			continue // ignored by go/build
+		}
+		src := filepath.Join(p, "src")
+		if _, ok := contextutil.HasSubdir(ctxt, src, dir); ok {
+			return src
+		}
+	}
+	return ""
 }
 
-// func Test2JsonExe(ctxt *build.Context) (string, error) {
-// 	goroot := runtime.GOROOT()
-// 	if !sameFile(ctxt.GOROOT, goroot) {
-// 		exe, err := exec.LookPath(filepath.Join(
-// 			ctxt.GOROOT, "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, "test2json",
-// 		))
-// 		if err == nil {
-// 			return exe, nil
-// 		}
-// 	}
-// 	return exec.LookPath(filepath.Join(
-// 		goroot, "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, "test2json",
-// 	))
-// }
-
-func RunTests(ctxt *build.Context, dirname string, args ...string) ([]Event, error) {
-	// test2json := filepath.Join(runtime.GOROOT(), "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, "test2json")
-	// tmpdir, err := os.MkdirTemp("", "gotest-util-*")
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// defer os.RemoveAll(tmpdir)
-	//
-	// stdout, err := os.Create(tmpdir + "/stdout.out")
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// defer stdout.Close()
-	//
-	// stderr, err := os.Create(tmpdir + "/stderr.out")
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// defer stderr.Close()
-
-	var stdout bytes.Buffer
-	cmd := buildutil.GoCommand(ctxt, "go", append([]string{"test"}, args...)...)
-	cmd.Dir = dirname
-	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return nil, err // WARN: include STDERR
-	}
-
-	return nil, nil
+var goModEnvCache struct {
+	sync.Mutex
+	vars map[string]map[string]string // directory => variables
 }
 
-func MatchContext(orig *build.Context, filename string) (*build.Context, error) {
-	ctxt, err := buildutil.MatchContext(orig, filename, nil)
-	if ctxt != nil {
-		ctxt.Dir = filepath.Dir(filename)
+// goModEnv returns the GOMOD and GOMODCACHE variables reported by the go
+// command run in directory dir. GOMOD is the go.mod file of the main
+// module, which is empty in GOPATH mode and os.DevNull in module mode
+// outside of a module. The result is cached by directory.
+func goModEnv(ctxt *build.Context, dir string) map[string]string {
+	goModEnvCache.Lock()
+	defer goModEnvCache.Unlock()
+	if vars, ok := goModEnvCache.vars[dir]; ok {
+		return vars
 	}
-	return ctxt, err
+	var vars map[string]string
+	out, err := goCommand(context.Background(), ctxt, dir, "env", "-json", "GOMOD", "GOMODCACHE").Output()
+	if err != nil || json.Unmarshal(out, &vars) != nil {
+		// Fallback to the go.mod file found by searching upwards from dir.
+		gomod, _ := findParentFile(dir, "go.mod")
+		vars = map[string]string{"GOMOD": gomod}
+	}
+	if goModEnvCache.vars == nil {
+		goModEnvCache.vars = make(map[string]map[string]string)
+	}
+	goModEnvCache.vars[dir] = vars
+	return vars
 }
 
-func stringsEqual(a1, a2 []string) bool {
-	if len(a1) != len(a2) {
+// inMainModule reports if dir belongs to the main module: the module
+// reported by "go env GOMOD" when run in ctxt.Dir or, if not set, the
+// working directory. Directories of nested modules and vendored packages,
+// and any directory in the module cache, are excluded.
+func inMainModule(ctxt *build.Context, dir string) bool {
+	wd := ctxt.Dir
+	if wd == "" {
+		var err error
+		if wd, err = os.Getwd(); err != nil {
+			return false
+		}
+	}
+	vars := goModEnv(ctxt, wd)
+	if cache := vars["GOMODCACHE"]; cache != "" {
+		if _, ok := contextutil.HasSubdir(ctxt, cache, dir); ok {
+			return false
+		}
+	}
+	mainMod := vars["GOMOD"]
+	if mainMod == "" || mainMod == os.DevNull {
 		return false
 	}
-	for i := range a1 {
-		if a1[i] != a2[i] {
-			goto tryUnordered
+	if gomod, ok := findParentFile(dir, "go.mod"); !ok || !sameFile(gomod, mainMod) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Dir(mainMod), dir)
+	if err != nil {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+		if elem == "vendor" {
+			return false
 		}
 	}
 	return true
+}
 
-tryUnordered:
-	// Ignore order
-	m := make(map[string]bool, len(a1))
-	for _, s := range a1 {
-		m[s] = true
+// testOnlyImports returns the sorted imports of pkg's test files that are
+// not imported by its non-test files. The package itself, which is imported
+// by external tests, is ignored.
+func testOnlyImports(pkg *build.Package) []string {
+	self := pkgImportPath(pkg)
+	seen := make(map[string]bool, len(pkg.Imports)+1)
+	for _, s := range pkg.Imports {
+		seen[s] = true
 	}
-	for _, s := range a2 {
-		if !m[s] {
-			return false
+	seen[self] = true
+	var imports []string
+	for _, list := range [][]string{pkg.TestImports, pkg.XTestImports} {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				imports = append(imports, s)
+			}
 		}
 	}
-	return true
+	sort.Strings(imports)
+	return imports
 }
 
-type GoEnv struct {
-	GoArch       *string `json:"GOARCH,omitempty"`
-	GoHostArch   *string `json:"GOHOSTARCH,omitempty"`
-	GoOS         *string `json:"GOOS,omitempty"`
-	GoHostOS     *string `json:"GOHOSTOS,omitempty"`
-	GoRoot       *string `json:"GOROOT,omitempty"`
-	GoPath       *string `json:"GOPATH,omitempty"`
-	CgoEnabled   *string `json:"CGO_ENABLED,omitempty"`
-	GoFlags      *string `json:"GOFLAGS,omitempty"`
-	GoExperiment *string `json:"GOEXPERIMENT,omitempty"`
-	// WARN: new
-	// GoTags       []string `json:"GOTAGS,omitempty"`
+// corpusFiles returns the number of files in the seed corpus directory
+// testdata/fuzz/NAME of the package in dir. The build context's ReadDir is
+// used, if set, so that alternate file systems are respected.
+func corpusFiles(ctxt *build.Context, dir, name string) int {
+	fis, err := util.ReadDir(ctxt, util.JoinPath(ctxt, dir, "testdata", "fuzz", name))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			n++
+		}
+	}
+	return n
 }
 
-func DiffGoEnv(orig, ctxt *build.Context) *GoEnv {
-	p := func(s string) *string {
-		return &s
+// dedupFiles removes any names in dir that denote the same file as a name
+// that precedes it. Files are opened through ctxt so that a file served from
+// the overlay of a Context returned by OverlayContextTracker is identified
+// by its overlay entry and not by any file it shadows on disk. The returned
+// map is keyed by the retained name and contains the names that were
+// collapsed into it.
+func dedupFiles(ctxt *build.Context, dir string, names []string) ([]string, map[string][]string) {
+	type fileInfo struct {
+		name    string
+		overlay string // name of the overlay entry, if overlaid
+		fi      os.FileInfo
 	}
-	e := new(GoEnv)
-	if ctxt.GOARCH != orig.GOARCH || ctxt.GOARCH != runtime.GOARCH {
-		e.GoArch = p(ctxt.GOARCH)
-		e.GoHostArch = p(runtime.GOARCH)
+	var aliases map[string][]string
+	seen := make([]fileInfo, 0, len(names))
+	uniq := names[:0:0]
+Loop:
+	for _, name := range names {
+		f := fileInfo{name: name}
+		rc, err := util.OpenFile(ctxt, util.JoinPath(ctxt, dir, name))
+		if err == nil {
+			switch rc := rc.(type) {
+			case *overlayFile:
+				f.overlay = rc.name
+			case *os.File:
+				f.fi, _ = rc.Stat()
+			}
+			rc.Close()
+		}
+		if f.overlay == "" && f.fi == nil {
+			// Unreadable file or a file opened by a custom
+			// Context.OpenFile: leave it to the parser to handle.
+			uniq = append(uniq, name)
+			continue
+		}
+		for _, x := range seen {
+			if f.overlay != "" && x.overlay == f.overlay ||
+				f.fi != nil && x.fi != nil && os.SameFile(x.fi, f.fi) {
+				if aliases == nil {
+					aliases = make(map[string][]string)
+				}
+				aliases[x.name] = append(aliases[x.name], name)
+				continue Loop
+			}
+		}
+		seen = append(seen, f)
+		uniq = append(uniq, name)
 	}
-	if ctxt.GOOS != orig.GOOS || ctxt.GOOS != runtime.GOOS {
-		e.GoOS = p(ctxt.GOOS)
-		e.GoHostOS = p(runtime.GOOS)
+	return uniq, aliases
+}
+
+// TODO: list funcs and methods as well
+func ListTests(ctxt *build.Context, dir string, opts *ListOptions) (*ListTestsResponse, error) {
+	return listTests(context.Background(), ctxt, dir, opts)
+}
+
+// listTests is ListTests with a context that cancels the build check (see
+// ListOptions.BuildCheck).
+func listTests(ctx context.Context, ctxt *build.Context, dir string, opts *ListOptions) (*ListTestsResponse, error) {
+	if opts == nil {
+		opts = new(ListOptions)
 	}
-	if ctxt.GOROOT != orig.GOROOT {
-		e.GoRoot = p(ctxt.GOROOT)
+	pkg, err := ctxt.ImportDir(dir, 0)
+	if err != nil {
+		var multi *build.MultiplePackageError
+		if errors.As(err, &multi) {
+			return packageClauseResponse(ctxt, dir, err)
+		}
+		// All of the Go files may have been excluded by the context,
+		// which is reported below.
+		var noGo *build.NoGoError
+		if !errors.As(err, &noGo) || pkg == nil {
+			return nil, err
+		}
 	}
-	if ctxt.GOPATH != orig.GOPATH {
-		e.GoPath = p(ctxt.GOPATH)
+
+	pkgRoot := packageRoot(ctxt, dir)
+	importPath := pkgImportPath(pkg)
+	goVersion, _ := goDirective(pkg.Dir)
+	if pkg.Goroot {
+		// Standard library packages are all rooted at GOROOT/src.
+		pkgRoot = filepath.Join(ctxt.GOROOT, "src")
 	}
-	if ctxt.CgoEnabled != orig.CgoEnabled {
-		e.CgoEnabled = p(strconv.FormatBool(ctxt.CgoEnabled))
+
+	var binaryName string
+	if opts.IncludeBinaryNames {
+		binaryName = escapePathOS(filepath.Clean(dir), ctxt.GOOS)
 	}
-	if !stringsEqual(ctxt.BuildTags, orig.BuildTags) {
-		// TODO: this is actually "build tags"
-		e.GoFlags = p(strings.Join(ctxt.BuildTags, ","))
+
+	var testImports []string
+	if opts.TestOnlyImports {
+		testImports = testOnlyImports(pkg)
 	}
-	if !stringsEqual(ctxt.ToolTags, orig.ToolTags) {
-		e.GoExperiment = p(strings.Join(ctxt.ToolTags, ","))
+
+	var buildID string
+	if opts.IncludeBuildID {
+		buildID, err = PackageBuildID(ctxt, pkg)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return e
-}
 
-// func DiffContexts(orig, ctxt *build.Context) map[string]string {
-// 	m := make(map[string]string)
-// 	if ctxt.GOARCH != orig.GOARCH {
-// 		m["GOARCH"] = ctxt.GOARCH
-// 		m["GOHOSTARCH"] = runtime.GOARCH
-// 	}
-// 	if ctxt.GOOS != orig.GOOS {
-// 		m["GOOS"] = ctxt.GOOS
-// 		m["GOHOSTOS"] = runtime.GOOS
-// 	}
-// 	if ctxt.GOROOT != orig.GOROOT {
-// 		m["GOROOT"] = ctxt.GOROOT
-// 	}
-// 	if ctxt.GOPATH != orig.GOPATH {
-// 		m["GOPATH"] = ctxt.GOPATH
-// 	}
-// 	if ctxt.CgoEnabled != orig.CgoEnabled {
-// 		m["CGO_ENABLED"] = strconv.FormatBool(ctxt.CgoEnabled)
-// 	}
-// 	if !stringsEqual(ctxt.BuildTags, orig.BuildTags) {
-// 		// WARN: this is actually "build tags"
-// 		m["GOFLAGS"] = strings.Join(ctxt.BuildTags, ",")
-// 	}
-// 	if !stringsEqual(ctxt.ToolTags, orig.ToolTags) {
-// 		m["GOEXPERIMENT"] = strings.Join(ctxt.ToolTags, ",")
-// 	}
-// 	return m
-// }
+	names := append(pkg.TestGoFiles, pkg.XTestGoFiles...)
+	if len(names) == 0 {
+		res := &ListTestsResponse{
+			PkgName:        pkg.Name,
+			PkgRoot:        pkgRoot,
+			ImportPath:     importPath,
+			Goroot:         pkg.Goroot,
+			InMainModule:   inMainModule(ctxt, pkg.Dir),
+			GoDirective:    goVersion,
+			TestBinaryName: binaryName,
+			BuildID:        buildID,
+		}
+		if hasTestFiles(pkg.IgnoredGoFiles) {
+			res.ContextExcludedAllTests = true
+			res.BuildTags = append([]string{}, ctxt.BuildTags...)
+		}
+		return res, nil
+	}
 
-func CopyContext(orig *build.Context) *build.Context {
-	if orig == nil {
-		orig = &build.Default
+	var buildable *bool
+	var buildErrs []string
+	if opts.BuildCheck {
+		ok, errs, err := BuildCheck(ctx, ctxt, dir)
+		if err != nil {
+			return nil, err
+		}
+		buildable, buildErrs = &ok, errs
 	}
-	dupe := *orig
-	dupe.BuildTags = append([]string(nil), orig.BuildTags...)
-	dupe.ToolTags = append([]string(nil), orig.ToolTags...)
-	dupe.ReleaseTags = append([]string(nil), orig.ReleaseTags...)
-	return &dupe
-}
 
-// OverlayContext overlays a build.Context with additional files from
-// a map. Files in the map take precedence over other files.
-//
-// In addition to plain string comparison, two file names are
-// considered equal if their base names match and their directory
-// components point at the same directory on the file system. That is,
-// symbolic links are followed for directories, but not files.
-//
-// A common use case for OverlayContext is to allow editors to pass in
-// a set of unsaved, modified files.
-//
-// Currently, only the Context.OpenFile function will respect the
-// overlay. This may change in the future.
-func OverlayContext(orig *build.Context, overlay map[string]string) *build.Context {
-	// TODO(dominikh): Implement IsDir, HasSubdir and ReadDir
+	var aliases map[string][]string
+	if opts.DeduplicateFiles {
+		names, aliases = dedupFiles(ctxt, dir, names)
+		if !opts.ReportAliases {
+			aliases = nil
+		}
+	}
 
-	copy := *orig // make a copy
-	ctxt := &copy
-	ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
-		// Fast path: names match exactly.
-		if content, ok := overlay[path]; ok {
-			return io.NopCloser(strings.NewReader(content)), nil
+	errs := make([]error, len(names))
+	files := make([]*ast.File, len(names))
+	fset := token.NewFileSet()
+	kinds, err := parseKinds(opts.Kinds)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSubtestOrder(opts.SortSubtests); err != nil {
+		return nil, err
+	}
+	v := &TestVisitor{Kinds: kinds}
+	wg := new(sync.WaitGroup)
+
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			af, err := util.ParseFile(fset, ctxt, nil, dir, name,
+				parser.ParseComments)
+			errs[i] = err
+			// Use any partial AST so that the tests of a file that is
+			// being edited are still reported.
+			if af != nil {
+				files[i] = af
+				ast.Walk(v, af)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	var parseErrors []FileError
+	for i, err := range errs {
+		if err != nil {
+			parseErrors = append(parseErrors, fileErrors(util.JoinPath(ctxt, dir, names[i]), err)...)
+		}
+	}
+
+	// Map each file name to its imports for the heuristics
+	imports := make(map[string]map[string]string, len(files))
+	for i, af := range files {
+		if af != nil {
+			imports[util.JoinPath(ctxt, dir, names[i])] = importNames(af)
 		}
+	}
 
-		// Slow path: check for same file under a different
-		// alias, perhaps due to a symbolic link.
-		for filename, content := range overlay {
-			if sameFile(path, filename) {
-				return io.NopCloser(strings.NewReader(content)), nil
+	var closures []*Closure
+	if opts.Closures {
+		for i, af := range files {
+			if af != nil {
+				closures = append(closures, findClosures(fset, af,
+					imports[util.JoinPath(ctxt, dir, names[i])])...)
 			}
 		}
+	}
 
-		return util.OpenFile(orig, path)
+	var constraints map[string]string
+	requiredTags := make(map[string]bool)
+	var archConstraints map[string][]string
+	var fileTags map[string][]string // custom tags required by each file
+	for i, af := range files {
+		if af == nil {
+			continue
+		}
+		filename := util.JoinPath(ctxt, dir, names[i])
+		x, err := FileConstraint(af, filename)
+		if err != nil {
+			if opts.IncludeConstraints {
+				parseErrors = append(parseErrors, fileErrors(filename, err)...)
+			}
+			continue
+		}
+		if x == nil {
+			continue
+		}
+		constraintTags(x, requiredTags)
+		if tags := requiredBuildTags(ctxt, x); tags != nil {
+			if fileTags == nil {
+				fileTags = make(map[string][]string)
+			}
+			fileTags[filename] = tags
+		}
+		if archs := archTargets(x); archs != nil {
+			if archConstraints == nil {
+				archConstraints = make(map[string][]string)
+			}
+			archConstraints[filename] = archs
+		}
+		if opts.IncludeConstraints {
+			if constraints == nil {
+				constraints = make(map[string]string)
+			}
+			constraints[filename] = x.String()
+		}
+	}
+	var astFiles map[string]*ast.File
+	var pkgVars map[string]map[string]bool // package name => variables
+	if opts.OrderDeps {
+		astFiles = make(map[string]*ast.File, len(files))
+		byPkg := make(map[string][]*ast.File)
+		for i, af := range files {
+			if af != nil {
+				astFiles[util.JoinPath(ctxt, dir, names[i])] = af
+				byPkg[af.Name.Name] = append(byPkg[af.Name.Name], af)
+			}
+		}
+		pkgVars = make(map[string]map[string]bool, len(byPkg))
+		for name, afs := range byPkg {
+			pkgVars[name] = packageVars(afs)
+		}
 	}
-	return ctxt
-}
 
-// sameFile returns true if x and y have the same basename and denote
-// the same file.
-func sameFile(x, y string) bool {
-	if x == y {
-		return true
+	var outputs map[string]bool
+	if len(v.Examples) > 0 {
+		outputs = exampleOutputs(files)
 	}
-	if filepath.Base(x) == filepath.Base(y) {
-		if path.Clean(x) == path.Clean(y) {
-			return true
+	annotate := func(d *ast.FuncDecl, def *FuncDefinition) {
+		def.RequiredTags = fileTags[def.Filename]
+		if opts.Signatures {
+			def.Signature = funcSignature(fset, d)
 		}
-		if xi, err := os.Stat(x); err == nil {
-			if yi, err := os.Stat(y); err == nil {
-				return os.SameFile(xi, yi)
+		if testFuncKind(def.Name) == kindFuzz {
+			def.CorpusFiles = corpusFiles(ctxt, pkg.Dir, def.Name)
+		}
+		switch testFuncKind(def.Name) {
+		case kindTest:
+			def.Parallel = callsParallel(imports[def.Filename], d)
+		case kindBenchmark:
+			def.Parallel = callsRunParallel(imports[def.Filename], d)
+		}
+		if testFuncKind(def.Name) == kindExample {
+			def.HasOutput = outputs[def.Name]
+			def.CompileOnly = !def.HasOutput
+		}
+		if (opts.Subtests || opts.GoTestNames) && testFuncKind(def.Name) == kindTest {
+			def.Subtests = findSubtests(imports[def.Filename], d)
+			if opts.GoTestNames {
+				def.GoTestNames = goTestNames(imports[def.Filename], d)
 			}
+			sortSubtests(def, opts.SortSubtests)
+		}
+		if opts.FlakyHeuristics {
+			def.FlakyRisk = flakyRisks(imports[def.Filename], d)
+		}
+		if opts.HermeticityCheck {
+			if pos, ok := writesOutsideTempDir(imports[def.Filename], d); ok {
+				def.WritesCWD = true
+				def.WritesCWDLine = fset.Position(pos).Line
+			}
+		}
+		if opts.DeadlineCheck {
+			def.DeadlineAware = callsDeadline(imports[def.Filename], d)
+		}
+		if opts.OrderDeps {
+			if af := astFiles[def.Filename]; af != nil {
+				def.WritesPackageVars = packageVarWrites(af, pkgVars[af.Name.Name], d)
+			}
+		}
+		if opts.DetectFramework {
+			def.Framework = testFramework(imports[def.Filename])
+		}
+		if opts.BenchmarkTimerCheck && testFuncKind(def.Name) == kindBenchmark {
+			def.MissingResetTimer = missingResetTimer(imports[def.Filename], d)
 		}
 	}
-	return false
+
+	res := &ListTestsResponse{
+		PkgName:      pkg.Name,
+		PkgRoot:      pkgRoot,
+		ImportPath:   importPath,
+		Goroot:       pkg.Goroot,
+		InMainModule: inMainModule(ctxt, pkg.Dir),
+		GoDirective:  goVersion,
+		HasTestMain:  v.TestMain != nil,
+		Tests:        declsToDefinitions(fset, filterDocTags(v.Tests, opts), annotate),
+		Benchmarks:   declsToDefinitions(fset, filterDocTags(v.Benchmarks, opts), annotate),
+		Examples:     declsToDefinitions(fset, filterDocTags(v.Examples, opts), annotate),
+		Fuzz:         declsToDefinitions(fset, filterDocTags(v.Fuzz, opts), annotate),
+		Aliases:      aliases,
+
+		TestBinaryName:  binaryName,
+		Constraints:     constraints,
+		RequiredTags:    stringSetKeys(requiredTags),
+		ArchConstraints: archConstraints,
+
+		TestOnlyImports: testImports,
+		BuildID:         buildID,
+		Buildable:       buildable,
+		BuildErrors:     buildErrs,
+		ParseErrors:     parseErrors,
+		Closures:        closures,
+	}
+	if len(opts.Ignore) != 0 {
+		res.Tests = filterIgnored(res.Tests, opts.Ignore, &res.Ignored)
+		res.Benchmarks = filterIgnored(res.Benchmarks, opts.Ignore, &res.Ignored)
+		res.Examples = filterIgnored(res.Examples, opts.Ignore, &res.Ignored)
+		res.Fuzz = filterIgnored(res.Fuzz, opts.Ignore, &res.Ignored)
+	}
+	if !opts.NoEnv {
+		res.GoEnv = DiffGoEnv(&build.Default, ctxt)
+	}
+	if opts.LinkExamples {
+		linkExamples(res.Examples, res.Tests)
+	}
+	res.FileLines = fileLines(res.Tests, res.Benchmarks, res.Examples, res.Fuzz)
+	if opts.OverlayTracker != nil {
+		res.Overlaid = make(map[string]bool, len(names))
+		for _, name := range names {
+			filename := util.JoinPath(ctxt, dir, name)
+			res.Overlaid[filename] = opts.OverlayTracker.Served(filename)
+		}
+	}
+	return res, nil
 }
 
-func ParseFileQuery(query string) (*token.Position, error) {
-	s := query
+// TestCounts are the number of tests, benchmarks, examples, fuzz targets
+// and subtests in a package.
+type TestCounts struct {
+	TestFiles  int `json:"test_files"`
+	Tests      int `json:"tests"`
+	Benchmarks int `json:"benchmarks"`
+	Examples   int `json:"examples"`
+	Fuzz       int `json:"fuzz"`
+
+	// Subtests is the number of subtests of the counted tests found by
+	// findSubtests: one per row of a table-driven test and one for each
+	// other call to t.Run.
+	Subtests int `json:"subtests"`
+}
 
-	i := strings.LastIndexByte(s, ':')
-	if i == -1 {
-		return nil, errors.New("invalid file query: missing column")
-	}
-	col, err := strconv.Atoi(s[i+1:])
+// A RecursiveListResponse lists the tests of every package beneath a
+// directory keyed by directory.
+type RecursiveListResponse struct {
+	Packages map[string]*ListTestsResponse `json:"packages"`
+
+	// Interrupted is set if listing was cancelled and Packages is
+	// incomplete.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// ListTestsRecursive lists the tests of every package beneath root (see
+// ListTestsRecursiveFunc). If ctx is cancelled the packages listed so far
+// are returned with Interrupted set.
+func ListTestsRecursive(ctx context.Context, ctxt *build.Context, root string, opts *ListOptions) (*RecursiveListResponse, error) {
+	results := make(map[string]*ListTestsResponse)
+	err := ListTestsRecursiveFunc(ctx, ctxt, root, opts, func(dir string, res *ListTestsResponse) error {
+		results[dir] = res
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("invalid file query: parsing column: %w", err)
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return &RecursiveListResponse{Packages: results, Interrupted: true}, nil
+		}
+		return nil, err
 	}
-	s = s[:i]
+	return &RecursiveListResponse{Packages: results}, nil
+}
 
-	i = strings.LastIndexByte(s, ':')
-	if i == -1 {
-		return nil, errors.New("invalid file query: missing line")
+// ListTestsRecursiveFunc calls fn with the tests of each package beneath
+// root (see walkPackageDirs) as they are listed. The packages are imported
+// concurrently by a bounded number of workers, but calls to fn are not
+// concurrent. Packages that fail to load, other than those whose files
+// disagree on their package name, are omitted. Listing stops if fn
+// returns an error.
+func ListTestsRecursiveFunc(ctx context.Context, ctxt *build.Context, root string, opts *ListOptions,
+	fn func(dir string, res *ListTestsResponse) error) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu    sync.Mutex
+		fnErr error
+		dirs  = make(chan string)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range dirs {
+				res, err := listTests(ctx, ctxt, dir, opts)
+				if res == nil || err != nil && !errors.As(err, new(*PackageClauseError)) {
+					continue
+				}
+				mu.Lock()
+				if fnErr == nil {
+					if fnErr = fn(dir, res); fnErr != nil {
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
 	}
-	line, err := strconv.Atoi(s[i+1:])
+	err := walkPackageDirs(ctx, root, func(dir string, _ []string) error {
+		select {
+		case dirs <- dir:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(dirs)
+	wg.Wait()
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// CountTests counts the tests in the package in dir. It is cheaper than
+// ListTests since comments are not retained, function bodies are only
+// inspected for subtests, and no FuncDefinitions are created. Files that cannot be
+// parsed are counted up to the first error. Only the DeduplicateFiles,
+// Kinds and Ignore options are used.
+func CountTests(ctxt *build.Context, dir string, opts *ListOptions) (*TestCounts, error) {
+	if opts == nil {
+		opts = new(ListOptions)
+	}
+	kinds, err := parseKinds(opts.Kinds)
 	if err != nil {
-		return nil, fmt.Errorf("invalid file query: parsing line: %w", err)
+		return nil, err
+	}
+	pkg, err := ctxt.ImportDir(dir, 0)
+	if err != nil {
+		var noGo *build.NoGoError
+		if !errors.As(err, &noGo) || pkg == nil {
+			return nil, err
+		}
+	}
+	names := append(pkg.TestGoFiles, pkg.XTestGoFiles...)
+	if opts.DeduplicateFiles {
+		names, _ = dedupFiles(ctxt, dir, names)
+	}
+
+	counts := make([]TestCounts, len(names))
+	fset := token.NewFileSet()
+	wg := new(sync.WaitGroup)
+	for i, name := range names {
+		wg.Add(1)
+		go func(c *TestCounts, name string) {
+			defer wg.Done()
+			// Objects are resolved to find the tables of table-driven
+			// subtests.
+			af, _ := util.ParseFile(fset, ctxt, nil, dir, name, 0)
+			if af == nil {
+				return
+			}
+			imports := importNames(af)
+			for _, decl := range af.Decls {
+				d, ok := decl.(*ast.FuncDecl)
+				if !ok || d.Name == nil || isTestMain(d) {
+					continue
+				}
+				kind := testFuncKind(d.Name.Name)
+				if len(kinds) != 0 && !kinds[kind] {
+					continue
+				}
+				if kind != kindNone && matchAny(opts.Ignore, d.Name.Name) {
+					continue
+				}
+				switch kind {
+				case kindTest:
+					c.Tests++
+					c.Subtests += len(findSubtests(imports, d))
+				case kindBenchmark:
+					c.Benchmarks++
+				case kindExample:
+					c.Examples++
+				case kindFuzz:
+					c.Fuzz++
+				}
+			}
+		}(&counts[i], name)
+	}
+	wg.Wait()
+
+	total := &TestCounts{TestFiles: len(names)}
+	for _, c := range counts {
+		total.Tests += c.Tests
+		total.Benchmarks += c.Benchmarks
+		total.Examples += c.Examples
+		total.Fuzz += c.Fuzz
+		total.Subtests += c.Subtests
+	}
+	return total, nil
+}
+
+type NoContainingFunctionError struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+}
+
+func (e *NoContainingFunctionError) Error() string {
+	return fmt.Sprintf("no containing function at: %s:%d:%d",
+		e.Filename, e.Line, e.Column)
+}
+
+type FuncVisitor struct {
+	Pos token.Pos
+	Fn  *ast.FuncDecl
+}
+
+func (v *FuncVisitor) Visit(node ast.Node) (w ast.Visitor) {
+	if v.Fn != nil {
+		return nil
+	}
+	if d, ok := node.(*ast.FuncDecl); ok && d != nil {
+		if d.Pos() <= v.Pos && v.Pos <= d.End() {
+			v.Fn = d
+			return nil
+		}
+	}
+	return v
+}
+
+// ContainingFunction returns the name of the function declared in filename
+// that contains line. The file is parsed directly and its build constraints
+// are ignored so that this works for files excluded from the current build
+// context (the user is editing the file so it is relevant regardless).
+//
+// TODO: use `findcall -name NAME *.go` to find references
+// where findcall is "golang.org/x/tools/go/analysis/passes/findcall/cmd/findcall"
+func ContainingFunction(filename string, src interface{}, line, column int) (string, error) {
+	return containingFunction(filename, src, line, column, false)
+}
+
+// PrecedingFunction is like ContainingFunction, but if the position is not
+// within a function (e.g. a blank or comment line between two functions) the
+// name of the nearest function declared before the position is returned.
+func PrecedingFunction(filename string, src interface{}, line, column int) (string, error) {
+	return containingFunction(filename, src, line, column, true)
+}
+
+func containingFunction(filename string, src interface{}, line, column int, preceding bool) (string, error) {
+	d, err := containingFuncDecl(filename, src, line, column, preceding)
+	if err != nil {
+		return "", err
+	}
+	return d.Name.Name, nil
+}
+
+// containingFuncDecl returns the named function declaration containing line
+// or, if preceding is true and there is none, the nearest declaration that
+// precedes it.
+func containingFuncDecl(filename string, src interface{}, line, column int, preceding bool) (*ast.FuncDecl, error) {
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if err != nil && af == nil {
+		return nil, err
+	}
+
+	file := fset.File(af.Pos())
+	if file == nil {
+		return nil, errors.New("ast: no pos for file")
+	}
+	if n := file.LineCount(); line < 1 || line > n {
+		return nil, fmt.Errorf("ast: invalid line number %d (should be between 1 and %d)", line, n)
+	}
+	pos := file.LineStart(line)
+	if !pos.IsValid() {
+		return nil, fmt.Errorf("ast: invalid pos for line: %d", line)
+	}
+	if d := funcDeclAt(af, pos, preceding); d != nil {
+		return d, nil
+	}
+	return nil, &NoContainingFunctionError{filename, line, column}
+}
+
+// ContainingFunctionOffset is like ContainingFunction but the position is
+// given as a byte offset into the file.
+func ContainingFunctionOffset(filename string, src interface{}, offset int) (string, error) {
+	d, err := containingFuncDeclOffset(filename, src, offset, false)
+	if err != nil {
+		return "", err
+	}
+	return d.Name.Name, nil
+}
+
+// containingFuncDeclPos returns the function declaration containing pos,
+// which is either a line and column or, if its Line is zero, an offset (see
+// ParseFileQuery).
+func containingFuncDeclPos(pos *token.Position, src interface{}, preceding bool) (*ast.FuncDecl, error) {
+	if pos.Line == 0 {
+		return containingFuncDeclOffset(pos.Filename, src, pos.Offset, preceding)
+	}
+	return containingFuncDecl(pos.Filename, src, pos.Line, pos.Column, preceding)
+}
+
+// containingFuncDeclOffset is like containingFuncDecl but the position is
+// given as a byte offset into the file.
+func containingFuncDeclOffset(filename string, src interface{}, offset int, preceding bool) (*ast.FuncDecl, error) {
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if err != nil && af == nil {
+		return nil, err
+	}
+
+	file := fset.File(af.Pos())
+	if file == nil {
+		return nil, errors.New("ast: no pos for file")
+	}
+	if n := file.Size(); offset < 0 || offset > n {
+		return nil, fmt.Errorf("ast: invalid offset %d (should be between 0 and %d)", offset, n)
+	}
+	pos := file.Pos(offset)
+	if d := funcDeclAt(af, pos, preceding); d != nil {
+		return d, nil
+	}
+	p := file.Position(pos)
+	return nil, &NoContainingFunctionError{filename, p.Line, p.Column}
+}
+
+// ContainingFunctions returns the names of the functions containing the
+// position line:column of a file from the outermost function declaration
+// to the innermost function literal. Function literals are named as by the
+// compiler: "TestFoo.func1" for the first literal of TestFoo, and
+// "TestFoo.func1.2" for the second literal within it.
+func ContainingFunctions(filename string, src interface{}, line, column int) ([]string, error) {
+	return containingFunctions(&token.Position{
+		Filename: filename,
+		Line:     line,
+		Column:   column,
+	}, src)
+}
+
+// containingFunctions is like ContainingFunctions but the position may also
+// be an offset (see ParseFileQuery).
+func containingFunctions(p *token.Position, src interface{}) ([]string, error) {
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, p.Filename, src, parser.SkipObjectResolution)
+	if err != nil && af == nil {
+		return nil, err
+	}
+	file := fset.File(af.Pos())
+	if file == nil {
+		return nil, errors.New("ast: no pos for file")
+	}
+
+	pos, err := queryPos(file, p)
+	if err != nil {
+		return nil, err
+	}
+	d := funcDeclAt(af, pos, false)
+	if d == nil {
+		p := file.Position(pos)
+		return nil, &NoContainingFunctionError{p.Filename, p.Line, p.Column}
+	}
+	return funcLitChain(d, pos), nil
+}
+
+// A Range is a selection of a file from Start to End inclusive, such as
+// the selection of an editor. Both positions are 1-based lines and columns.
+type Range struct {
+	Start, End token.Position
+}
+
+// ParseRange parses a range of the form "START_LINE:START_COL-END_LINE:END_COL".
+func ParseRange(s string) (*Range, error) {
+	i := strings.IndexByte(s, '-')
+	if i == -1 {
+		return nil, fmt.Errorf("invalid range %q: expected START_LINE:START_COL-END_LINE:END_COL", s)
+	}
+	var r Range
+	for _, x := range []struct {
+		s string
+		p *token.Position
+	}{{s[:i], &r.Start}, {s[i+1:], &r.End}} {
+		line, col, ok := strings.Cut(x.s, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q: expected START_LINE:START_COL-END_LINE:END_COL", s)
+		}
+		var err error
+		if x.p.Line, err = strconv.Atoi(line); err != nil || x.p.Line < 1 {
+			return nil, fmt.Errorf("invalid range %q: invalid line %q", s, line)
+		}
+		if x.p.Column, err = strconv.Atoi(col); err != nil || x.p.Column < 1 {
+			return nil, fmt.Errorf("invalid range %q: invalid column %q", s, col)
+		}
+	}
+	if r.End.Line < r.Start.Line || r.End.Line == r.Start.Line && r.End.Column < r.Start.Column {
+		return nil, fmt.Errorf("invalid range %q: end precedes start", s)
+	}
+	return &r, nil
+}
+
+// FunctionsInRange returns the functions of the file filename that overlap
+// the range r, in the order they are declared. A function overlaps r if any
+// position from its "func" keyword to its closing brace is within r: a
+// range within a single function returns only it and a range that spans
+// multiple functions returns all of them, including those it only partially
+// covers. Doc comments and the space between functions are not part of any
+// function. A NoContainingFunctionError is returned, for the start of r, if
+// no function overlaps it.
+func FunctionsInRange(filename string, src interface{}, r *Range) ([]AffectedFunction, error) {
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if err != nil && af == nil {
+		return nil, err
+	}
+	file := fset.File(af.Pos())
+	if file == nil {
+		return nil, errors.New("ast: no pos for file")
+	}
+	start, err := queryPos(file, &token.Position{Line: r.Start.Line, Column: r.Start.Column})
+	if err != nil {
+		return nil, err
+	}
+	// Like editors, which may select the end of a file as the start of the
+	// following line, clamp the end to the file and to its own line.
+	endLine := r.End.Line
+	if n := file.LineCount(); endLine > n {
+		endLine = n
+	}
+	end, err := queryPos(file, &token.Position{Line: endLine, Column: r.End.Column})
+	if err != nil {
+		return nil, err
+	}
+	if endLine < file.LineCount() && end >= file.LineStart(endLine+1) {
+		end = file.LineStart(endLine+1) - 1
+	}
+	var funcs []AffectedFunction
+	for _, decl := range af.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Name == nil || d.Pos() > end || d.End() <= start {
+			continue
+		}
+		funcs = append(funcs, AffectedFunction{
+			FuncRef: FuncRef{
+				Name:     d.Name.Name,
+				Filename: filename,
+				Line:     fset.Position(d.Pos()).Line,
+			},
+			EndLine: fset.Position(d.End()).Line,
+			Kind:    funcKindName(filename, d),
+		})
+	}
+	if len(funcs) == 0 {
+		p := file.Position(start)
+		return nil, &NoContainingFunctionError{p.Filename, p.Line, p.Column}
+	}
+	return funcs, nil
+}
+
+// queryPos returns the position of file given by the line and column or, if
+// its Line is zero, the offset of p (see ParseFileQuery). Columns beyond the
+// end of the line are clamped to it and a column less than 1 is treated as
+// the start of the line.
+func queryPos(file *token.File, p *token.Position) (token.Pos, error) {
+	if p.Line == 0 {
+		if n := file.Size(); p.Offset < 0 || p.Offset > n {
+			return token.NoPos, fmt.Errorf("ast: invalid offset %d (should be between 0 and %d)", p.Offset, n)
+		}
+		return file.Pos(p.Offset), nil
+	}
+	if n := file.LineCount(); p.Line < 1 || p.Line > n {
+		return token.NoPos, fmt.Errorf("ast: invalid line number %d (should be between 1 and %d)", p.Line, n)
+	}
+	pos := file.LineStart(p.Line)
+	if p.Column > 1 {
+		end := token.Pos(file.Base() + file.Size())
+		if p.Line < file.LineCount() {
+			end = file.LineStart(p.Line + 1)
+		}
+		if pos += token.Pos(p.Column - 1); pos > end {
+			pos = end
+		}
+	}
+	return pos, nil
+}
+
+// funcLitChain returns the name of d followed by the names of the nested
+// function literals of d that contain pos.
+func funcLitChain(d *ast.FuncDecl, pos token.Pos) []string {
+	name := d.Name.Name
+	names := []string{name}
+	if d.Body == nil {
+		return names
+	}
+	sep := ".func"
+	body := d.Body
+	for {
+		// Literals are numbered in source order within their enclosing
+		// function and the literals nested in them are numbered separately.
+		n := 0
+		var next *ast.FuncLit
+		ast.Inspect(body, func(node ast.Node) bool {
+			if next != nil {
+				return false
+			}
+			lit, ok := node.(*ast.FuncLit)
+			if !ok {
+				return true
+			}
+			n++
+			if lit.Pos() <= pos && pos <= lit.End() {
+				next = lit
+			}
+			return false
+		})
+		if next == nil {
+			return names
+		}
+		name += sep + strconv.Itoa(n)
+		sep = "."
+		names = append(names, name)
+		body = next.Body
+	}
+}
+
+// funcDeclAt returns the named function declaration of af containing pos
+// or, if preceding is true and there is none, the nearest declaration that
+// precedes it. Nil is returned if there is no such declaration.
+func funcDeclAt(af *ast.File, pos token.Pos, preceding bool) *ast.FuncDecl {
+	// Fast check
+	for _, node := range af.Decls {
+		if d, ok := node.(*ast.FuncDecl); ok && d != nil {
+			if d.Pos() <= pos && pos <= d.End() {
+				if d.Name != nil {
+					return d
+				}
+			}
+		}
+	}
+
+	v := FuncVisitor{Pos: pos}
+	ast.Walk(&v, af)
+
+	if v.Fn != nil && v.Fn.Name != nil {
+		return v.Fn
+	}
+
+	if preceding {
+		var prev *ast.FuncDecl
+		for _, node := range af.Decls {
+			if d, ok := node.(*ast.FuncDecl); ok && d != nil && d.Name != nil {
+				if d.End() < pos {
+					prev = d
+				}
+			}
+		}
+		return prev
+	}
+	return nil
+}
+
+// A TestConfig is the configuration of a go test run that is set by the
+// tool's flags.
+type TestConfig struct {
+	Verbose bool
+	Short   bool
+	Race    bool
+}
+
+// Args returns the go test flags of c.
+func (c *TestConfig) Args() []string {
+	var args []string
+	if c.Verbose {
+		args = append(args, "-v")
+	}
+	if c.Short {
+		args = append(args, "-short")
+	}
+	if c.Race {
+		args = append(args, "-race")
+	}
+	return args
+}
+
+type Event struct {
+	Time    *time.Time `json:",omitempty"`
+	Action  string
+	Package string   `json:",omitempty"`
+	Test    string   `json:",omitempty"`
+	Elapsed *float64 `json:",omitempty"`
+	Output  *string  `json:",omitempty"`
+}
+
+// Sources of the test2json executable returned by FindTest2Json.
+const (
+	Test2JsonContext = "context" // the build context's GOROOT
+	Test2JsonRuntime = "runtime" // the GOROOT of this program
+	Test2JsonGoTool  = "go-tool" // built on demand by "go tool"
+)
+
+// Test2JsonExe returns the path of the test2json executable for ctxt.
+func Test2JsonExe(ctxt *build.Context) (string, error) {
+	exe, _, err := FindTest2Json(ctxt)
+	return exe, err
+}
+
+// FindTest2Json returns the path of the test2json executable and its
+// source. The test2json of the build context's GOROOT is preferred and
+// the one of runtime.GOROOT is used if it is not found. Newer toolchains
+// do not ship a prebuilt test2json, in which case the path reported by
+// "go tool -n test2json" is used.
+func FindTest2Json(ctxt *build.Context) (exe, source string, err error) {
+	goroot := runtime.GOROOT()
+	if ctxt.GOROOT != "" && !sameFile(ctxt.GOROOT, goroot) {
+		exe, err := exec.LookPath(filepath.Join(
+			ctxt.GOROOT, "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, "test2json",
+		))
+		if err == nil {
+			return exe, Test2JsonContext, nil
+		}
+	}
+	exe, err = exec.LookPath(filepath.Join(
+		goroot, "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, "test2json",
+	))
+	if err != nil {
+		out, gerr := buildutil.GoCommand(ctxt, "go", "tool", "-n", "test2json").Output()
+		if gerr != nil || len(bytes.TrimSpace(out)) == 0 {
+			return "", "", err
+		}
+		return string(bytes.TrimSpace(out)), Test2JsonGoTool, nil
+	}
+	if sameFile(ctxt.GOROOT, goroot) {
+		return exe, Test2JsonContext, nil
+	}
+	return exe, Test2JsonRuntime, nil
+}
+
+// goModFlag is the value of the -mod build flag used by the go commands
+// run by this program (see the --mod flag). It is empty if the go
+// command's default should be used.
+var goModFlag = "readonly"
+
+// goModFlagSet is set if goModFlag was provided by the --mod flag, in
+// which case it takes precedence over any -mod flag in GOFLAGS.
+var goModFlagSet bool
+
+// knownModFlags are the valid values of the -mod build flag.
+var knownModFlags = map[string]bool{
+	"":         true,
+	"mod":      true,
+	"readonly": true,
+	"vendor":   true,
+}
+
+// goCommand returns a go command for ctxt that is run in directory dir. If
+// dir is in a module, GOFLAGS is updated to include the -mod flag (see
+// goModFlag) so that the command does not unexpectedly modify go.mod or
+// download modules.
+//
+// The -mod flag is chosen as follows, from highest to lowest precedence:
+//
+//  1. The --mod flag, if provided.
+//  2. The -mod flag of GOFLAGS, whether set in the environment or with
+//     "go env -w", which is left as is.
+//  3. The go command's default if the module is vendored (has a
+//     vendor/modules.txt file), which is -mod=vendor.
+//  4. The default value of goModFlag.
+func goCommand(ctx context.Context, ctxt *build.Context, dir string, args ...string) *exec.Cmd {
+	cmd := buildutil.GoCommandContext(ctx, ctxt, "go", args...)
+	cmd.Dir = dir
+	if goModFlag == "" {
+		return cmd
+	}
+	gomod, ok := findParentFile(dir, "go.mod")
+	if !ok {
+		return cmd // the -mod flag is an error in GOPATH mode
+	}
+	goflags := -1
+	for i, kv := range cmd.Env {
+		if strings.HasPrefix(kv, "GOFLAGS=") {
+			goflags = i
+		}
+	}
+	if !goModFlagSet {
+		if goflags != -1 && hasModFlag(cmd.Env[goflags]) ||
+			hasModFlag(goEnvVars(ctxt)["GOFLAGS"]) ||
+			isVendored(filepath.Dir(gomod)) {
+			return cmd
+		}
+	}
+	flag := "-mod=" + goModFlag
+	if goflags != -1 {
+		// Later flags take precedence.
+		cmd.Env[goflags] = strings.TrimSpace(cmd.Env[goflags] + " " + flag)
+		return cmd
+	}
+	cmd.Env = append(cmd.Env, "GOFLAGS="+flag)
+	return cmd
+}
+
+// hasModFlag reports if the GOFLAGS value goflags sets the -mod flag.
+func hasModFlag(goflags string) bool {
+	for _, f := range strings.Fields(strings.TrimPrefix(goflags, "GOFLAGS=")) {
+		if strings.HasPrefix(f, "-mod=") || strings.HasPrefix(f, "--mod=") {
+			return true
+		}
+	}
+	return false
+}
+
+// isVendored reports if the module rooted at dir has a vendor directory
+// that the go command will use by default.
+func isVendored(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, "vendor", "modules.txt"))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// RunTests runs "go test -json" with args for the package in dirname and
+// returns the decoded test events. The -json flag is added if not present
+// in args. If go test fails, such as when a test fails, the events that
+// were decoded are returned along with an error that includes the
+// command's stderr.
+func RunTests(ctxt *build.Context, dirname string, args ...string) ([]Event, error) {
+	var events []Event
+	err := RunTestsFunc(ctxt, dirname, func(e Event) error {
+		events = append(events, e)
+		return nil
+	}, args...)
+	return events, err
+}
+
+// RunTestsContext is like RunTests but the go command, and the test binary
+// it runs, are killed if ctx is cancelled.
+func RunTestsContext(ctx context.Context, ctxt *build.Context, dirname string, args ...string) ([]Event, error) {
+	var events []Event
+	err := runTests(ctx, ctxt, dirname, nil, func(e Event) error {
+		events = append(events, e)
+		return nil
+	}, args...)
+	return events, err
+}
+
+// RunTestsFunc is like RunTests but calls fn with each event as it is
+// decoded instead of returning them. If fn returns an error the go
+// command is cancelled and the error is returned.
+func RunTestsFunc(ctxt *build.Context, dirname string, fn func(Event) error, args ...string) error {
+	return runTests(context.Background(), ctxt, dirname, nil, fn, args...)
+}
+
+// runTests is RunTestsFunc with a context that cancels the go command.
+// The go command's stderr, which is included in the returned error, is
+// also copied to teeStderr if it is not nil.
+func runTests(ctx context.Context, ctxt *build.Context, dirname string, teeStderr io.Writer,
+	fn func(Event) error, args ...string) error {
+
+	if !stringsContain(args, "-json") {
+		args = append([]string{"-json"}, args...)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	// The context is not passed to the command since that would only kill
+	// the go command and not the test binary.
+	cmd := goCommand(context.Background(), ctxt, dirname, append([]string{"test"}, args...)...)
+	cmd.Stderr = &stderr
+	if teeStderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, teeStderr)
+	}
+	setProcessGroup(cmd)
+	rc, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	wait := cancelProcessGroup(ctx, cmd)
+
+	var decodeErr error
+	dec := json.NewDecoder(rc)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			if err != io.EOF {
+				decodeErr = fmt.Errorf("decoding test events: %w", err)
+			}
+			break
+		}
+		if err := fn(e); err != nil {
+			cancel()
+			io.Copy(io.Discard, rc)
+			wait()
+			return err
+		}
+	}
+	io.Copy(io.Discard, rc) // drain so that the command can exit
+
+	if err := wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s := bytes.TrimSpace(stderr.Bytes()); len(s) != 0 {
+			return fmt.Errorf("go test failed: %w\n%s", err, s)
+		}
+		return fmt.Errorf("go test failed: %w", err)
+	}
+	return decodeErr
+}
+
+// cancelProcessGroup kills the process group of the started command cmd
+// (see setProcessGroup) if ctx is done before it exits. The returned
+// function waits for cmd to exit and must be called exactly once.
+func cancelProcessGroup(ctx context.Context, cmd *exec.Cmd) func() error {
+	var mu sync.Mutex
+	exited := false
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !exited {
+				killProcessGroup(cmd.Process)
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() error {
+		err := cmd.Wait()
+		mu.Lock()
+		exited = true
+		mu.Unlock()
+		close(done)
+		return err
+	}
+}
+
+func MatchContext(orig *build.Context, filename string) (*build.Context, error) {
+	ctxt, err := buildutil.MatchContext(orig, filename, nil)
+	if ctxt != nil {
+		ctxt.Dir = filepath.Dir(filename)
+	}
+	return ctxt, err
+}
+
+func stringsContain(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stringsEqual(a1, a2 []string) bool {
+	if len(a1) != len(a2) {
+		return false
+	}
+	for i := range a1 {
+		if a1[i] != a2[i] {
+			goto tryUnordered
+		}
+	}
+	return true
+
+tryUnordered:
+	// Ignore order
+	m := make(map[string]bool, len(a1))
+	for _, s := range a1 {
+		m[s] = true
+	}
+	for _, s := range a2 {
+		if !m[s] {
+			return false
+		}
+	}
+	return true
+}
+
+type GoEnv struct {
+	GoArch       *string `json:"GOARCH,omitempty"`
+	GoHostArch   *string `json:"GOHOSTARCH,omitempty"`
+	GoOS         *string `json:"GOOS,omitempty"`
+	GoHostOS     *string `json:"GOHOSTOS,omitempty"`
+	GoRoot       *string `json:"GOROOT,omitempty"`
+	GoPath       *string `json:"GOPATH,omitempty"`
+	CgoEnabled   *string `json:"CGO_ENABLED,omitempty"`
+	GoFlags      *string `json:"GOFLAGS,omitempty"`
+	GoExperiment *string `json:"GOEXPERIMENT,omitempty"`
+
+	// GoTags are the build tags of the context if they differ from the
+	// default. There is no GOTAGS environment variable: the tags are
+	// passed to the go command with -tags (see Environ).
+	GoTags []string `json:"GOTAGS,omitempty"`
+}
+
+// A BuildContext is the JSON form of the fields of a build.Context that
+// determine which files are matched. Unlike GoEnv every field is included
+// even if it has its default value.
+type BuildContext struct {
+	GOOS          string   `json:"GOOS"`
+	GOARCH        string   `json:"GOARCH"`
+	GOROOT        string   `json:"GOROOT"`
+	GOPATH        string   `json:"GOPATH"`
+	Dir           string   `json:"dir"`
+	CgoEnabled    bool     `json:"cgo_enabled"`
+	UseAllFiles   bool     `json:"use_all_files"`
+	Compiler      string   `json:"compiler"`
+	BuildTags     []string `json:"build_tags"`
+	ToolTags      []string `json:"tool_tags"`
+	ReleaseTags   []string `json:"release_tags"`
+	InstallSuffix string   `json:"install_suffix"`
+}
+
+// NewBuildContext returns the BuildContext of ctxt.
+func NewBuildContext(ctxt *build.Context) *BuildContext {
+	// Use empty slices so that missing tags are encoded as [] not null.
+	tags := func(a []string) []string {
+		return append([]string{}, a...)
+	}
+	return &BuildContext{
+		GOOS:          ctxt.GOOS,
+		GOARCH:        ctxt.GOARCH,
+		GOROOT:        ctxt.GOROOT,
+		GOPATH:        ctxt.GOPATH,
+		Dir:           ctxt.Dir,
+		CgoEnabled:    ctxt.CgoEnabled,
+		UseAllFiles:   ctxt.UseAllFiles,
+		Compiler:      ctxt.Compiler,
+		BuildTags:     tags(ctxt.BuildTags),
+		ToolTags:      tags(ctxt.ToolTags),
+		ReleaseTags:   tags(ctxt.ReleaseTags),
+		InstallSuffix: ctxt.InstallSuffix,
+	}
+}
+
+// gopathList returns the cleaned, non-empty entries of ctxt.GOPATH.
+func gopathList(ctxt *build.Context) []string {
+	var list []string
+	for _, s := range filepath.SplitList(ctxt.GOPATH) {
+		if s != "" {
+			list = append(list, filepath.Clean(s))
+		}
+	}
+	return list
+}
+
+// gopathEqual reports if the GOPATH of contexts a and b contain the same
+// entries in the same order (order matters since the first entry that
+// contains a package wins). Empty entries and formatting differences,
+// such as trailing separators, are ignored.
+func gopathEqual(a, b *build.Context) bool {
+	if a.GOPATH == b.GOPATH {
+		return true
+	}
+	l1 := gopathList(a)
+	l2 := gopathList(b)
+	if len(l1) != len(l2) {
+		return false
+	}
+	for i := range l1 {
+		if l1[i] != l2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func DiffGoEnv(orig, ctxt *build.Context) *GoEnv {
+	p := func(s string) *string {
+		return &s
+	}
+	e := new(GoEnv)
+	if ctxt.GOARCH != orig.GOARCH || ctxt.GOARCH != runtime.GOARCH {
+		e.GoArch = p(ctxt.GOARCH)
+		e.GoHostArch = p(runtime.GOARCH)
+	}
+	if ctxt.GOOS != orig.GOOS || ctxt.GOOS != runtime.GOOS {
+		e.GoOS = p(ctxt.GOOS)
+		e.GoHostOS = p(runtime.GOOS)
+	}
+	if ctxt.GOROOT != orig.GOROOT {
+		e.GoRoot = p(ctxt.GOROOT)
+	}
+	if !gopathEqual(ctxt, orig) {
+		e.GoPath = p(ctxt.GOPATH)
+	}
+	if ctxt.CgoEnabled != orig.CgoEnabled {
+		e.CgoEnabled = p(strconv.FormatBool(ctxt.CgoEnabled))
+	}
+	if !stringsEqual(ctxt.BuildTags, orig.BuildTags) {
+		e.GoTags = append([]string{}, ctxt.BuildTags...)
+	}
+	vars := goEnvVars(ctxt)
+	if s := vars["GOFLAGS"]; s != "" {
+		e.GoFlags = p(s)
+	}
+	if s := vars["GOEXPERIMENT"]; s != "" {
+		e.GoExperiment = p(s)
+	}
+	return e
+}
+
+var goEnvCache struct {
+	sync.Mutex
+	vars map[string]map[string]string // GOROOT => variables
+}
+
+// goEnvVars returns the GOFLAGS and GOEXPERIMENT variables of the go command
+// of ctxt's GOROOT, which include those set with "go env -w", if they differ
+// from the defaults of the toolchain. The go command is run with the
+// environment of this process and not that of ctxt (see goCommand), whose
+// build and tool tags would otherwise be reported as GOFLAGS and
+// GOEXPERIMENT. Toolchains older than go1.23, which do not support
+// "go env -changed", report the variables as set. If the go command fails
+// the variables are read from the environment. The result is cached by
+// GOROOT.
+func goEnvVars(ctxt *build.Context) map[string]string {
+	goEnvCache.Lock()
+	defer goEnvCache.Unlock()
+	if vars, ok := goEnvCache.vars[ctxt.GOROOT]; ok {
+		return vars
+	}
+	goexe := filepath.Join(ctxt.GOROOT, "bin", "go")
+	if _, err := os.Stat(goexe); err != nil {
+		goexe = "go"
+	}
+	var vars map[string]string
+	for _, args := range [][]string{
+		{"env", "-changed", "-json", "GOFLAGS", "GOEXPERIMENT"},
+		{"env", "-json", "GOFLAGS", "GOEXPERIMENT"},
+	} {
+		out, err := exec.Command(goexe, args...).Output()
+		if err == nil && json.Unmarshal(out, &vars) == nil {
+			break
+		}
+		vars = nil
+	}
+	if vars == nil {
+		vars = map[string]string{
+			"GOFLAGS":      os.Getenv("GOFLAGS"),
+			"GOEXPERIMENT": os.Getenv("GOEXPERIMENT"),
+		}
+	}
+	if goEnvCache.vars == nil {
+		goEnvCache.vars = make(map[string]map[string]string)
+	}
+	goEnvCache.vars[ctxt.GOROOT] = vars
+	return vars
+}
+
+// Environ returns the variables set in e as "KEY=value" pairs. GOHOSTOS
+// and GOHOSTARCH are omitted since they are informational and cannot be
+// changed via the environment.
+func (e *GoEnv) Environ() []string {
+	var env []string
+	add := func(key string, val *string) {
+		if val != nil {
+			env = append(env, key+"="+*val)
+		}
+	}
+	add("GOARCH", e.GoArch)
+	add("GOOS", e.GoOS)
+	add("GOROOT", e.GoRoot)
+	add("GOPATH", e.GoPath)
+	add("CGO_ENABLED", e.CgoEnabled)
+	// The go command reads the build tags from GOFLAGS.
+	var goflags []string
+	if e.GoFlags != nil {
+		goflags = append(goflags, *e.GoFlags)
+	}
+	if len(e.GoTags) != 0 {
+		goflags = append(goflags, "-tags="+strings.Join(e.GoTags, ","))
+	}
+	if len(goflags) != 0 {
+		env = append(env, "GOFLAGS="+strings.Join(goflags, " "))
+	}
+	add("GOEXPERIMENT", e.GoExperiment)
+	return env
+}
+
+// shellQuote quotes s for a POSIX shell, if necessary.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.,:/=+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeShellEnv writes env as commands that set the variables for the shell
+// of goos: "set" commands for the Windows command prompt or "export"
+// commands for a POSIX shell.
+func writeShellEnv(w io.Writer, env []string, goos string) error {
+	for _, kv := range env {
+		var err error
+		if goos == "windows" {
+			_, err = fmt.Fprintf(w, "set \"%s\"\n", kv)
+		} else {
+			key, val, _ := strings.Cut(kv, "=")
+			_, err = fmt.Fprintf(w, "export %s=%s\n", key, shellQuote(val))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A DirEnv is the Go environment of a package directory.
+type DirEnv struct {
+	GoEnv *GoEnv `json:"go_env"`
+
+	// Heterogeneous is true if the build constraints of some of the
+	// directory's files imply a different environment. Those files
+	// and their environments are listed in Files.
+	Heterogeneous bool              `json:"heterogeneous,omitempty"`
+	Files         map[string]*GoEnv `json:"files,omitempty"`
+}
+
+// RecursiveGoEnv returns the Go environment of each package directory
+// beneath root keyed by directory.
+func RecursiveGoEnv(ctx context.Context, ctxt *build.Context, root string) (map[string]*DirEnv, error) {
+	dirs := make(map[string]*DirEnv)
+	err := RecursiveGoEnvFunc(ctx, ctxt, root, func(dir string, de *DirEnv) error {
+		dirs[dir] = de
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// RecursiveGoEnvFunc calls fn with the Go environment of each package
+// directory beneath root as it is walked. The walk stops if fn returns an
+// error.
+func RecursiveGoEnvFunc(ctx context.Context, ctxt *build.Context, root string, fn func(dir string, de *DirEnv) error) error {
+	return walkPackageDirs(ctx, root, func(dir string, names []string) error {
+		de := &DirEnv{GoEnv: DiffGoEnv(&build.Default, ctxt)}
+		for _, name := range names {
+			filename := filepath.Join(dir, name)
+			fctxt, err := MatchContext(ctxt, filename)
+			if err != nil {
+				// Ignore files that cannot be matched (e.g. syntax errors)
+				continue
+			}
+			if env := DiffGoEnv(&build.Default, fctxt); !reflect.DeepEqual(env, de.GoEnv) {
+				if de.Files == nil {
+					de.Files = make(map[string]*GoEnv)
+				}
+				de.Files[filename] = env
+				de.Heterogeneous = true
+			}
+		}
+		return fn(dir, de)
+	})
+}
+
+// func DiffContexts(orig, ctxt *build.Context) map[string]string {
+// 	m := make(map[string]string)
+// 	if ctxt.GOARCH != orig.GOARCH {
+// 		m["GOARCH"] = ctxt.GOARCH
+// 		m["GOHOSTARCH"] = runtime.GOARCH
+// 	}
+// 	if ctxt.GOOS != orig.GOOS {
+// 		m["GOOS"] = ctxt.GOOS
+// 		m["GOHOSTOS"] = runtime.GOOS
+// 	}
+// 	if ctxt.GOROOT != orig.GOROOT {
+// 		m["GOROOT"] = ctxt.GOROOT
+// 	}
+// 	if ctxt.GOPATH != orig.GOPATH {
+// 		m["GOPATH"] = ctxt.GOPATH
+// 	}
+// 	if ctxt.CgoEnabled != orig.CgoEnabled {
+// 		m["CGO_ENABLED"] = strconv.FormatBool(ctxt.CgoEnabled)
+// 	}
+// 	if !stringsEqual(ctxt.BuildTags, orig.BuildTags) {
+// 		// WARN: this is actually "build tags"
+// 		m["GOFLAGS"] = strings.Join(ctxt.BuildTags, ",")
+// 	}
+// 	if !stringsEqual(ctxt.ToolTags, orig.ToolTags) {
+// 		m["GOEXPERIMENT"] = strings.Join(ctxt.ToolTags, ",")
+// 	}
+// 	return m
+// }
+
+func CopyContext(orig *build.Context) *build.Context {
+	if orig == nil {
+		orig = &build.Default
+	}
+	dupe := *orig
+	dupe.BuildTags = append([]string(nil), orig.BuildTags...)
+	dupe.ToolTags = append([]string(nil), orig.ToolTags...)
+	dupe.ReleaseTags = append([]string(nil), orig.ReleaseTags...)
+	return &dupe
+}
+
+// OverlayContext overlays a build.Context with additional files from
+// a map. Files in the map take precedence over other files.
+//
+// In addition to plain string comparison, two file names are
+// considered equal if their base names match and their directory
+// components point at the same directory on the file system. That is,
+// symbolic links are followed for directories, but not files.
+//
+// A common use case for OverlayContext is to allow editors to pass in
+// a set of unsaved, modified files.
+//
+// Currently, only the Context.OpenFile function will respect the
+// overlay. This may change in the future.
+func OverlayContext(orig *build.Context, overlay map[string]string) *build.Context {
+	return OverlayContextTracker(orig, overlay, nil)
+}
+
+// An OverlayTracker records the files opened by a Context returned by
+// OverlayContextTracker that were served from its overlay.
+type OverlayTracker struct {
+	mu     sync.Mutex
+	served map[string]bool
+}
+
+func (t *OverlayTracker) add(path string) {
+	t.mu.Lock()
+	if t.served == nil {
+		t.served = make(map[string]bool)
+	}
+	t.served[path] = true
+	t.mu.Unlock()
+}
+
+// Served reports if the file path was read from the overlay.
+func (t *OverlayTracker) Served(path string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.served[path]
+}
+
+// An overlayFile is a file served from the overlay of a Context returned by
+// OverlayContextTracker.
+type overlayFile struct {
+	*strings.Reader
+	name string // name of the file in the overlay
+}
+
+func (*overlayFile) Close() error { return nil }
+
+// OverlayContextTracker is like OverlayContext but records the files served
+// from the overlay in t, if not nil.
+func OverlayContextTracker(orig *build.Context, overlay map[string]string, t *OverlayTracker) *build.Context {
+	// TODO(dominikh): Implement IsDir, HasSubdir and ReadDir
+
+	open := func(path, filename, content string) (io.ReadCloser, error) {
+		if t != nil {
+			t.add(path)
+		}
+		return &overlayFile{strings.NewReader(content), filename}, nil
+	}
+
+	copy := *orig // make a copy
+	ctxt := &copy
+	ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
+		// Fast path: names match exactly.
+		if content, ok := overlay[path]; ok {
+			return open(path, path, content)
+		}
+
+		// Slow path: check for same file under a different
+		// alias, perhaps due to a symbolic link.
+		for filename, content := range overlay {
+			if sameFile(path, filename) {
+				return open(path, filename, content)
+			}
+		}
+
+		return util.OpenFile(orig, path)
+	}
+	return ctxt
+}
+
+// sameFile returns true if x and y have the same basename and denote
+// the same file.
+func sameFile(x, y string) bool {
+	if x == y {
+		return true
+	}
+	if filepath.Base(x) == filepath.Base(y) {
+		if path.Clean(x) == path.Clean(y) {
+			return true
+		}
+		if xi, err := os.Stat(x); err == nil {
+			if yi, err := os.Stat(y); err == nil {
+				return os.SameFile(xi, yi)
+			}
+		}
+	}
+	return false
+}
+
+// ParseFileQuery parses a query of the form "FILE:LINE:COLUMN" or
+// "FILE:#OFFSET", where OFFSET is a byte offset into the file. The Line of
+// the position of an offset query is zero.
+func ParseFileQuery(query string) (*token.Position, error) {
+	s := query
+
+	i := strings.LastIndexByte(s, ':')
+	if i == -1 {
+		return nil, errors.New("invalid file query: missing column")
+	}
+	if strings.HasPrefix(s[i+1:], "#") {
+		offset, err := strconv.Atoi(s[i+2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid file query: parsing offset: %w", err)
+		}
+		if offset < 0 {
+			return nil, fmt.Errorf("invalid file query: negative offset: %d", offset)
+		}
+		return &token.Position{Filename: s[:i], Offset: offset}, nil
+	}
+	col, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid file query: parsing column: %w", err)
+	}
+	s = s[:i]
+
+	i = strings.LastIndexByte(s, ':')
+	if i == -1 {
+		return nil, errors.New("invalid file query: missing line")
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid file query: parsing line: %w", err)
+	}
+
+	name := s[:i]
+	return &token.Position{Filename: name, Line: line, Column: col}, nil
+}
+
+// ParseFileLineQuery parses a query of the form "FILE:LINE".
+func ParseFileLineQuery(query string) (*token.Position, error) {
+	i := strings.LastIndexByte(query, ':')
+	if i == -1 {
+		return nil, errors.New("invalid file query: missing line")
+	}
+	line, err := strconv.Atoi(query[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid file query: parsing line: %w", err)
+	}
+	return &token.Position{Filename: query[:i], Line: line}, nil
+}
+
+// // WARN: use or remove
+// type ErrorWriter struct {
+// 	w io.Writer
+// }
+//
+// // WARN: use or remove
+// func (e *ErrorWriter) Write(p []byte) (int, error) {
+// 	json.NewEncoder(e.w).Encode(struct {
+// 		Error string `json:"error"`
+// 	}{string(p)})
+// 	return len(p), nil
+// }
+
+type OverlayJSON struct {
+	Replace map[string]string `json:"replace"`
+}
+
+// funcCmdArgs validates the arguments of the function command: a single
+// FILE_QUERY or, with --from-diff, none.
+func funcCmdArgs(cmd *cobra.Command, args []string) error {
+	if fromDiff, _ := cmd.Flags().GetBool("from-diff"); fromDiff {
+		return cobra.NoArgs(cmd, args)
+	}
+	return cobra.ExactArgs(1)(cmd, args)
+}
+
+// parseTagsFlag parses the value of the -tags flag, which like the go
+// command may be a comma separated list or, for compatibility, a space
+// separated one.
+func parseTagsFlag(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if !strings.Contains(s, ",") {
+		return strings.Fields(s)
+	}
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// readFile reads the named file using the build context's OpenFile
+// function, if set, so that overlays are respected.
+func readFile(ctxt *build.Context, name string) ([]byte, error) {
+	f, err := util.OpenFile(ctxt, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WARN: remove if not used
+func isFile(ctxt *build.Context, name string) bool {
+	if ctxt != nil && ctxt.OpenFile != nil {
+		f, err := ctxt.OpenFile(name)
+		if err != nil {
+			return false
+		}
+		f.Close()
+		return true
+	}
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// knownBuildModes are the build modes accepted by "go build -buildmode".
+//
+// Unlike the -race, -msan and -asan flags, which add the "race", "msan"
+// and "asan" build tags, none of the build modes imply any build tags so
+// the build context used for discovery is the same for all of them.
+var knownBuildModes = map[string]bool{
+	"archive":   true,
+	"c-archive": true,
+	"c-shared":  true,
+	"default":   true,
+	"exe":       true,
+	"pie":       true,
+	"plugin":    true,
+	"shared":    true,
+}
+
+// Exit codes returned by the tool.
+const (
+	ExitSuccess     = 0 // success
+	ExitFailure     = 1 // tool or usage error
+	ExitTestsFailed = 2 // one or more tests failed
+	ExitBuildFailed = 3 // the tests could not be built
+)
+
+// An ExitError is returned by a command to exit with a code other than
+// ExitFailure.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// exitCode returns the exit code for the error returned by a command.
+func exitCode(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+	var e *ExitError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ExitFailure
+}
+
+// startProfiling starts writing a CPU profile to cpuprofile, if set, and
+// returns a function that stops CPU profiling and writes a heap profile to
+// memprofile, if set. The returned function must always be called.
+func startProfiling(cpuprofile, memprofile string) (stop func() error, err error) {
+	var cpuFile *os.File
+	if cpuprofile != "" {
+		cpuFile, err = os.Create(cpuprofile)
+		if err != nil {
+			return nopStop, err
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nopStop, err
+		}
+	}
+	stop = func() error {
+		var first error
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			first = cpuFile.Close()
+		}
+		if memprofile != "" {
+			f, err := os.Create(memprofile)
+			if err != nil {
+				return err
+			}
+			runtime.GC() // get up-to-date statistics
+			if err := pprof.WriteHeapProfile(f); err != nil && first == nil {
+				first = err
+			}
+			if err := f.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	return stop, nil
+}
+
+func nopStop() error { return nil }
+
+// stopProfiling stops any profiling started by the --cpuprofile and
+// --memprofile flags.
+var stopProfiling = nopStop
+
+// stdout is where commands write their output. Once the flags are parsed
+// it is a buffered writer (see bufferOutput) that must be flushed by
+// flushOutput when writing a stream of objects.
+var stdout io.Writer = os.Stdout
+
+var (
+	// flushOutput flushes any buffered or compressed output to os.Stdout.
+	flushOutput = nopStop
+
+	// closeOutput flushes stdout and closes any compression of it.
+	closeOutput = nopStop
+)
+
+// bufferOutput buffers writes to stdout and, if compress is true, gzip
+// compresses them.
+func bufferOutput(compress bool) {
+	var zw *gzip.Writer
+	w := io.Writer(os.Stdout)
+	if compress {
+		zw = gzip.NewWriter(os.Stdout)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+	stdout = bw
+	flushOutput = func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if zw != nil {
+			return zw.Flush()
+		}
+		return nil
+	}
+	closeOutput = func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if zw != nil {
+			return zw.Close()
+		}
+		return nil
+	}
+}
+
+// indentJSON is set by the --indent flag.
+var indentJSON bool
+
+// newEncoder returns a JSON encoder that writes to w and indents its output
+// if the --indent flag is set. Newline delimited output, such as that of
+// streamJSON, is never indented.
+func newEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if indentJSON {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+// streamJSON writes v to stdout as a single line of JSON and flushes it so
+// that line oriented consumers receive it immediately.
+func streamJSON(v interface{}) error {
+	if err := json.NewEncoder(stdout).Encode(v); err != nil {
+		return err
+	}
+	return flushOutput()
+}
+
+func main() {
+	ctxt := CopyContext(&build.Default)
+	ctxt.HasSubdir = contextutil.HasSubdirFunc(ctxt)
+
+	// overlayFiles are the file contents given by the --overlay flag.
+	var overlayFiles map[string]string
+	// overlayTracker records the files read from overlayFiles.
+	overlayTracker := new(OverlayTracker)
+
+	// The go test configuration set by the persistent flags.
+	var testConfig TestConfig
+
+	// The duration of --timeout (zero if not set) and the function that
+	// releases the context it bounds.
+	var timeout time.Duration
+	cancelTimeout := func() {}
+
+	root := cobra.Command{
+		Use: "gotest-util",
+		Long: "gotest-util is a helper for discovering and running Go tests.\n\n" +
+			"Exit codes:\n" +
+			"  0  success\n" +
+			"  1  tool or usage error\n" +
+			"  2  one or more tests failed\n" +
+			"  3  the tests could not be built\n\n" +
+			"Defaults for the global flags may be set in a " + ConfigFileName + " or\n" +
+			YAMLConfigFileName + " file in the working directory or any of its\n" +
+			"parents. The file is a JSON object, or YAML mapping, of flag names to\n" +
+			"values. Flags given on the command line override the config file, which\n" +
+			"overrides the flag defaults.",
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			if err := loadConfigFlags(cmd); err != nil {
+				return err
+			}
+
+			cpuprofile, err := cmd.Flags().GetString("cpuprofile")
+			if err != nil {
+				return err // should never happen
+			}
+			memprofile, err := cmd.Flags().GetString("memprofile")
+			if err != nil {
+				return err // should never happen
+			}
+			stopProfiling, err = startProfiling(cpuprofile, memprofile)
+			if err != nil {
+				return err
+			}
+
+			compress, err := cmd.Flags().GetBool("gzip")
+			if err != nil {
+				return err // should never happen
+			}
+			bufferOutput(compress)
+
+			compact, err := cmd.Flags().GetBool("json-compact")
+			if err != nil {
+				return err // should never happen
+			}
+			stream, err := cmd.Flags().GetBool("json-stream")
+			if err != nil {
+				return err // should never happen
+			}
+			if compact && stream {
+				return errors.New("cmd: --json-compact cannot be used with --json-stream")
+			}
+			if compact {
+				indentJSON = false
+			}
+
+			buildmode, err := cmd.Flags().GetString("buildmode")
+			if err != nil {
+				return err // should never happen
+			}
+			if buildmode != "" && !knownBuildModes[buildmode] {
+				return fmt.Errorf("invalid -buildmode: %q", buildmode)
+			}
+
+			goModFlag, err = cmd.Flags().GetString("mod")
+			if err != nil {
+				return err // should never happen
+			}
+			goModFlagSet = cmd.Flags().Changed("mod")
+			if !knownModFlags[goModFlag] {
+				return fmt.Errorf("invalid -mod: %q", goModFlag)
+			}
+
+			tags, err := cmd.Flags().GetString("tags")
+			if err != nil {
+				return err // should never happen
+			}
+			ctxt.BuildTags = append(ctxt.BuildTags, parseTagsFlag(tags)...)
+			testConfig.Verbose, err = cmd.Flags().GetBool("verbose")
+			if err != nil {
+				return err // should never happen
+			}
+			testConfig.Short, err = cmd.Flags().GetBool("short")
+			if err != nil {
+				return err // should never happen
+			}
+			testConfig.Race, err = cmd.Flags().GetBool("race")
+			if err != nil {
+				return err // should never happen
+			}
+			// Like go test -race, which sets the "race" build tag, so that
+			// files that require it are listed.
+			if testConfig.Race && !stringsContain(ctxt.BuildTags, "race") {
+				ctxt.BuildTags = append(ctxt.BuildTags, "race")
+			}
+
+			timeoutFlag, err := cmd.Flags().GetString("timeout")
+			if err != nil {
+				return err // should never happen
+			}
+			if timeoutFlag != "" {
+				timeout, err = time.ParseDuration(timeoutFlag)
+				if err != nil || timeout < 0 {
+					return fmt.Errorf("invalid -timeout: %q", timeoutFlag)
+				}
+			}
+			if timeout > 0 {
+				// Like the go command, which kills a test binary a minute
+				// after its timeout, allow go test to report the tests
+				// that timed out before cancelling.
+				ctx, cancel := context.WithTimeout(cmd.Context(), timeout+time.Minute)
+				cmd.SetContext(ctx)
+				cancelTimeout = cancel
+			}
+
+			overlay, err := cmd.Flags().GetString("overlay")
+			if err != nil {
+				return err // should never happen
+			}
+			if strings.TrimSpace(overlay) == "" {
+				return nil
+			}
+			var o OverlayJSON
+			dec := json.NewDecoder(strings.NewReader(overlay))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&o); err != nil {
+				return err
+			}
+			if len(o.Replace) > 0 {
+				ctxt = OverlayContextTracker(ctxt, o.Replace, overlayTracker)
+				overlayFiles = o.Replace
+			}
+			return nil
+		},
+	}
+	root.SilenceUsage = true
+
+	flags := root.PersistentFlags()
+	flags.String("tags", "", "build tags")
+	flags.String("overlay", "",
+		"read a JSON config file that provides an overlay for build operations")
+	flags.Bool("race", false, "enable race detection")
+	flags.BoolP("verbose", "v", false, "run go test with -v")
+	flags.Bool("short", false, "tell long running tests to shorten their run time (go test -short)")
+	flags.String("timeout", "",
+		"fail tests that run longer than `duration` (passed to go test as -timeout)\n"+
+			"and cancel the tool's own operations shortly after it elapses")
+	flags.String("buildmode", "", "build mode to use when running tests (see: go help buildmode)")
+	flags.String("mod", goModFlag,
+		"module download mode used by go commands: mod, readonly or vendor\n"+
+			"(empty to use the go command's default). Unless provided, a -mod flag\n"+
+			"in GOFLAGS or a vendored module takes precedence over the default")
+	flags.Bool("gzip", false, "gzip compress the output")
+	flags.BoolVar(&indentJSON, "indent", false,
+		"indent JSON output for readability (newline delimited output is not indented)")
+	flags.Bool("json-stream", false,
+		"write results as newline delimited JSON objects, each flushed as soon as it\n"+
+			"is available (env --recursive and list --recursive; the events of run are\n"+
+			"always streamed)")
+	flags.Bool("json-compact", false,
+		"write each result as a single JSON document on one line, overriding --indent")
+	flags.String("cpuprofile", "", "write a CPU profile of the tool to `file`")
+	flags.String("memprofile", "", "write a memory profile of the tool to `file`")
+	flags.MarkHidden("cpuprofile")
+	flags.MarkHidden("memprofile")
+
+	var listOpts ListOptions
+	listCmd := cobra.Command{
+		Use:   "list [FILE]",
+		Short: "List runnable Go tests",
+		Long: "List runnable Go tests.\n\n" +
+			"With --recursive the argument is a directory and the tests of each\n" +
+			"package directory beneath it are printed, keyed by directory. With\n" +
+			"--json-stream each package is printed as a line of JSON, with its\n" +
+			"\"dir\", as soon as it is listed.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err // should never happen
+			}
+			dirname := "."
+			// If a file is provided match the context to it.
+			if len(args) == 1 && !recursive {
+				dirname = filepath.Dir(args[0])
+				ctxt, err = MatchContext(ctxt, args[0])
+				if err != nil {
+					return err
+				}
+			}
+			dirname, err = filepath.Abs(dirname)
+			if err != nil {
+				return err
+			}
+
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				return err // should never happen
+			}
+			resolveOverlay, err := cmd.Flags().GetBool("resolve-overlay-paths")
+			if err != nil {
+				return err // should never happen
+			}
+			if resolveOverlay {
+				listOpts.OverlayTracker = overlayTracker
+			}
+			ignoreFile, err := cmd.Flags().GetString("ignore-file")
+			if err != nil {
+				return err // should never happen
+			}
+			if ignoreFile != "" {
+				listOpts.Ignore, err = ReadIgnoreFile(ignoreFile)
+				if err != nil {
+					return err
+				}
+			}
+
+			countOnly, err := cmd.Flags().GetBool("count-only")
+			if err != nil {
+				return err // should never happen
+			}
+			if recursive {
+				if countOnly || format != "json" {
+					return errors.New("list: --recursive cannot be used with --count-only or --format other than json")
+				}
+				if len(args) == 1 {
+					dirname, err = filepath.Abs(args[0])
+					if err != nil {
+						return err
+					}
+				}
+				stream, err := cmd.Flags().GetBool("json-stream")
+				if err != nil {
+					return err // should never happen
+				}
+				if stream {
+					err := ListTestsRecursiveFunc(cmd.Context(), ctxt, dirname, &listOpts,
+						func(dir string, res *ListTestsResponse) error {
+							return streamJSON(struct {
+								Dir string `json:"dir"`
+								*ListTestsResponse
+							}{dir, res})
+						})
+					if err != nil && cmd.Context().Err() != nil && errors.Is(err, cmd.Context().Err()) {
+						// Mark the end of the partial results.
+						return streamJSON(struct {
+							Interrupted bool `json:"interrupted"`
+						}{true})
+					}
+					return err
+				}
+				res, err := ListTestsRecursive(cmd.Context(), ctxt, dirname, &listOpts)
+				if err != nil {
+					return err
+				}
+				return newEncoder(stdout).Encode(res)
+			}
+			if countOnly {
+				counts, err := CountTests(ctxt, dirname, &listOpts)
+				if err != nil {
+					return err
+				}
+				return newEncoder(stdout).Encode(counts)
+			}
+
+			opts := &listOpts
+			if format == "sarif" {
+				opts = sarifListOptions(listOpts)
+			}
+			defs, err := listTests(cmd.Context(), ctxt, dirname, opts)
+			if err != nil {
+				// Report the package clause of each file so that the
+				// disagreement can be located.
+				var clauseErr *PackageClauseError
+				if errors.As(err, &clauseErr) && defs != nil && format == "json" {
+					if eerr := newEncoder(stdout).Encode(defs); eerr != nil {
+						return eerr
+					}
+				}
+				return err
+			}
+
+			switch format {
+			case "make":
+				return writeMakefile(stdout, defs, dirname)
+			case "sarif":
+				return newEncoder(stdout).Encode(sarifReport(defs))
+			case "json":
+				return newEncoder(stdout).Encode(defs)
+			default:
+				return fmt.Errorf("invalid --format: %q", format)
+			}
+		},
+	}
+
+	listCmd.Flags().BoolVar(&listOpts.DeduplicateFiles, "deduplicate-files", true,
+		"collapse test files that resolve to the same underlying file")
+	listCmd.Flags().BoolVar(&listOpts.ReportAliases, "report-aliases", false,
+		"report the test files collapsed by --deduplicate-files in the \"aliases\" field")
+	listCmd.Flags().BoolVar(&listOpts.IncludeBinaryNames, "include-binary-names", false,
+		"include the package's escaped test binary name")
+	listCmd.Flags().BoolVar(&listOpts.Subtests, "subtests", false,
+		"list the subtests run by each test with t.Run")
+	listCmd.Flags().BoolVar(&listOpts.GoTestNames, "go-test-names", false,
+		"also list the full name of each subtest exactly as go test reports it\n"+
+			"(e.g. \"TestFoo/a_case#01\"), implies --subtests")
+	listCmd.Flags().StringVar(&listOpts.SortSubtests, "sort-subtests", subtestOrderPosition,
+		"order of the subtests of each test: position (source and execution order) or name")
+	listCmd.Flags().BoolVar(&listOpts.Signatures, "signatures", false,
+		"include the signature of each function (e.g. \"func TestFoo(t *testing.T)\")")
+	listCmd.Flags().BoolVar(&listOpts.FlakyHeuristics, "flaky-heuristics", false,
+		"report tests that use time, the network or unseeded randomness (advisory)")
+	listCmd.Flags().BoolVar(&listOpts.IncludeConstraints, "include-constraints", false,
+		"include the build constraint of each test file")
+	listCmd.Flags().BoolVar(&listOpts.HermeticityCheck, "hermeticity-check", false,
+		"report tests that write files outside of a temporary directory (advisory)")
+	listCmd.Flags().BoolVar(&listOpts.DeadlineCheck, "deadline-check", false,
+		"report tests that call t.Deadline (advisory)")
+	listCmd.Flags().BoolVar(&listOpts.OrderDeps, "order-deps", false,
+		"report the package level variables written by each function (advisory)")
+	listCmd.Flags().BoolVar(&listOpts.DetectFramework, "framework", false,
+		"report the test framework (e.g. testify) used by each function's file")
+	listCmd.Flags().BoolVar(&listOpts.BenchmarkTimerCheck, "benchmark-timer-check", false,
+		"report benchmarks with setup that is not excluded by b.ResetTimer (advisory)")
+	listCmd.Flags().BoolVar(&listOpts.TestOnlyImports, "test-only-imports", false,
+		"include the imports only used by the package's tests")
+	listCmd.Flags().BoolVar(&listOpts.IncludeBuildID, "include-build-id", false,
+		"include a hash of the package's sources, go.mod, build tags and GOOS/GOARCH")
+	listCmd.Flags().BoolVar(&listOpts.LinkExamples, "link-examples", false,
+		"link each example to the test of the symbol it documents")
+	listCmd.Flags().BoolVar(&listOpts.NoEnv, "no-env", false,
+		"do not include the Go environment in the response")
+	listCmd.Flags().BoolVar(&listOpts.Closures, "closures", false,
+		"include function literals that take a *testing.T (not runnable)")
+	listCmd.Flags().StringSliceVar(&listOpts.DocTags, "doc-tag", nil,
+		"only list functions whose doc comment contains `tag` (may be repeated)")
+	listCmd.Flags().BoolVar(&listOpts.DocTagsAll, "doc-tag-all", false,
+		"require every --doc-tag to match instead of any")
+	listCmd.Flags().BoolVar(&listOpts.BuildCheck, "build-check", false,
+		"report if the package's tests compile (slow)")
+	listCmd.Flags().StringSliceVar(&listOpts.Kinds, "kind", nil,
+		"only list functions of `kind`: test, benchmark, example or fuzz (may be repeated)")
+	listCmd.Flags().Bool("resolve-overlay-paths", false,
+		"report whether each test file was read from the --overlay or from disk")
+	listCmd.Flags().String("ignore-file", "",
+		"exclude the functions matching the patterns in `file`, one glob (or regexp\n"+
+			"prefixed with \"re:\") per line, and list them as ignored")
+	listCmd.Flags().String("format", "json",
+		"output `format`: \"json\", \"make\" (a Makefile fragment with a target per test)\n"+
+			"or \"sarif\" (the advisory findings of the heuristics as a SARIF 2.1.0 log)")
+	listCmd.Flags().BoolP("recursive", "r", false,
+		"list the tests of every package beneath the directory argument")
+	listCmd.Flags().Bool("count-only", false,
+		"only print the number of tests, benchmarks, examples, fuzz targets and subtests")
+
+	var countOpts ListOptions
+	contextCmd := cobra.Command{
+		Use:   "context FILE",
+		Short: "Print the complete build context matching FILE",
+		Long: "Print every field of the build context that determines which files are\n" +
+			"matched, after it has been matched to FILE. Unlike env, which only\n" +
+			"prints the environment that differs from the default, fields with\n" +
+			"their default value are included.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			ctxt, err := MatchContext(ctxt, args[0])
+			if err != nil {
+				return err
+			}
+			return newEncoder(stdout).Encode(NewBuildContext(ctxt))
+		},
+	}
+
+	countCmd := cobra.Command{
+		Use:   "count [FILE]",
+		Short: "Print the number of tests, benchmarks, examples, fuzz targets and subtests",
+		Long: "Print the number of tests, benchmarks, examples, fuzz targets and subtests\n" +
+			"of the package containing FILE (or the current directory). This is cheaper\n" +
+			"than list since the definitions of the functions are not computed.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			dirname := "."
+			if len(args) == 1 {
+				dirname = filepath.Dir(args[0])
+				ctxt, err = MatchContext(ctxt, args[0])
+				if err != nil {
+					return err
+				}
+			}
+			dirname, err = filepath.Abs(dirname)
+			if err != nil {
+				return err
+			}
+			ignoreFile, err := cmd.Flags().GetString("ignore-file")
+			if err != nil {
+				return err // should never happen
+			}
+			if ignoreFile != "" {
+				countOpts.Ignore, err = ReadIgnoreFile(ignoreFile)
+				if err != nil {
+					return err
+				}
+			}
+			counts, err := CountTests(ctxt, dirname, &countOpts)
+			if err != nil {
+				return err
+			}
+			return newEncoder(stdout).Encode(counts)
+		},
+	}
+	countCmd.Flags().BoolVar(&countOpts.DeduplicateFiles, "deduplicate-files", true,
+		"collapse test files that resolve to the same underlying file")
+	countCmd.Flags().StringSliceVar(&countOpts.Kinds, "kind", nil,
+		"only count functions of `kind`: test, benchmark, example or fuzz (may be repeated)")
+	countCmd.Flags().String("ignore-file", "",
+		"do not count the functions matching the patterns in `file` (see list --ignore-file)")
+
+	envCmd := cobra.Command{
+		Use:     "env FILE",
+		Aliases: []string{"environment"},
+		Short:   "Print the Go environment matching FILE",
+		Long: "Print the Go environment matching FILE.\n\n" +
+			"With --recursive the argument is a directory and the environment of\n" +
+			"each package directory beneath it is printed, keyed by directory.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err // should never happen
+			}
+			shell, err := cmd.Flags().GetBool("shell")
+			if err != nil {
+				return err // should never happen
+			}
+			withCounts, err := cmd.Flags().GetBool("with-counts")
+			if err != nil {
+				return err // should never happen
+			}
+			if recursive && shell {
+				return errors.New("env: --shell cannot be used with --recursive")
+			}
+			if withCounts && (recursive || shell) {
+				return errors.New("env: --with-counts cannot be used with --recursive or --shell")
+			}
+			if recursive {
+				root, err := filepath.Abs(args[0])
+				if err != nil {
+					return err
+				}
+				stream, err := cmd.Flags().GetBool("json-stream")
+				if err != nil {
+					return err // should never happen
+				}
+				if stream {
+					return RecursiveGoEnvFunc(cmd.Context(), ctxt, root,
+						func(dir string, de *DirEnv) error {
+							return streamJSON(struct {
+								Dir string `json:"dir"`
+								*DirEnv
+							}{dir, de})
+						})
+				}
+				envs, err := RecursiveGoEnv(cmd.Context(), ctxt, root)
+				if err != nil {
+					return err
+				}
+				return newEncoder(stdout).Encode(envs)
+			}
+			ctxt, err := MatchContext(ctxt, args[0])
+			if err != nil {
+				return err
+			}
+			env := DiffGoEnv(&build.Default, ctxt)
+			if shell {
+				return writeShellEnv(stdout, env.Environ(), runtime.GOOS)
+			}
+			if withCounts {
+				dirname, err := filepath.Abs(filepath.Dir(args[0]))
+				if err != nil {
+					return err
+				}
+				counts, err := CountTests(ctxt, dirname, &ListOptions{DeduplicateFiles: true})
+				if err != nil {
+					return err
+				}
+				return newEncoder(stdout).Encode(struct {
+					*GoEnv
+					*TestCounts
+				}{env, counts})
+			}
+			return newEncoder(stdout).Encode(env)
+		},
+	}
+
+	envCmd.Flags().BoolP("recursive", "r", false,
+		"print the environment of every package directory beneath a directory")
+	envCmd.Flags().Bool("shell", false,
+		"print the environment as shell commands that can be eval'd")
+	envCmd.Flags().Bool("with-counts", false,
+		"include the number of test files and tests of the FILE's package")
+
+	funcCmd := cobra.Command{
+		Use:   "function FILE_QUERY",
+		Short: "Print the function containing the cursor",
+		Long: "Print the function containing the cursor at FILE_QUERY, which is either\n" +
+			"FILE:LINE:COLUMN or FILE:#OFFSET where OFFSET is a byte offset.\n\n" +
+			"With --from-diff a unified diff is read from stdin instead and the\n" +
+			"distinct functions containing its changed lines are printed. File\n" +
+			"names in the diff are relative to the working directory.\n\n" +
+			"With --range FILE_QUERY is a file name and the functions overlapping\n" +
+			"the range are printed: only the function containing the range or, if\n" +
+			"it spans multiple functions, every function it covers even partially.",
+		Example: fmt.Sprintf("%s function ./main.go:12:8\n"+
+			"%[1]s function ./main.go:#1234\n"+
+			"git diff | %[1]s function --from-diff\n"+
+			"%[1]s function --range 12:1-40:3 ./main_test.go", filepath.Base(os.Args[0])),
+		Args: func(cmd *cobra.Command, args []string) error {
+			// With --json-errors the argument count is checked by RunE
+			// so that the error is reported as JSON.
+			if jsonErrors, _ := cmd.Flags().GetBool("json-errors"); jsonErrors {
+				return nil
+			}
+			return funcCmdArgs(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			preferPreceding, err := cmd.Flags().GetBool("prefer-preceding")
+			if err != nil {
+				return err // should never happen
+			}
+			offset, err := cmd.Flags().GetInt("offset")
+			if err != nil {
+				return err // should never happen
+			}
+			jsonErrors, err := cmd.Flags().GetBool("json-errors")
+			if err != nil {
+				return err // should never happen
+			}
+
+			writeResult := func(funcName string, chain []string, err error) error {
+				var errMsg string
+				if err != nil {
+					errMsg = err.Error()
+				}
+				return newEncoder(stdout).Encode(struct {
+					Name      string   `json:"name"`
+					Functions []string `json:"functions,omitempty"`
+					Error     string   `json:"error,omitempty"`
+				}{funcName, chain, errMsg})
+			}
+			// fail returns err or, with --json-errors, writes it as the
+			// result.
+			fail := func(err error) error {
+				if jsonErrors {
+					return writeResult("", nil, err)
+				}
+				return err
+			}
+			if err := funcCmdArgs(cmd, args); err != nil {
+				return fail(err)
+			}
+
+			fromDiff, err := cmd.Flags().GetBool("from-diff")
+			if err != nil {
+				return err // should never happen
+			}
+			if fromDiff {
+				changed, err := ParseDiffLines(os.Stdin)
+				if err != nil {
+					return fail(err)
+				}
+				funcs, err := AffectedFunctions(ctxt, changed)
+				if err != nil {
+					return fail(err)
+				}
+				return newEncoder(stdout).Encode(funcs)
+			}
+
+			rangeFlag, err := cmd.Flags().GetString("range")
+			if err != nil {
+				return err // should never happen
+			}
+			if rangeFlag != "" {
+				r, err := ParseRange(rangeFlag)
+				if err != nil {
+					return fail(err)
+				}
+				src, err := readFile(ctxt, args[0])
+				if err != nil {
+					return fail(err)
+				}
+				funcs, err := FunctionsInRange(args[0], src, r)
+				if err != nil {
+					return fail(err)
+				}
+				return newEncoder(stdout).Encode(funcs)
+			}
+
+			// With --offset the argument is only a file name.
+			var pos *token.Position
+			if offset >= 0 {
+				pos = &token.Position{Filename: args[0], Offset: offset}
+			} else {
+				pos, err = ParseFileQuery(args[0])
+				if err != nil {
+					return fail(err)
+				}
+			}
+
+			// Handle file overlays
+			src, err := readFile(ctxt, pos.Filename)
+			if err != nil {
+				return fail(err)
+			}
+
+			// Return any error here as part of the JSON response.
+			var funcName string
+			var chain []string
+			d, err := containingFuncDeclPos(pos, src, preferPreceding)
+			if err == nil {
+				funcName = d.Name.Name
+				// The enclosing function literals, if the position is
+				// within the function and not preceding it.
+				if fns, err := containingFunctions(pos, src); err == nil && fns[0] == funcName {
+					chain = fns
+				}
+			}
+			return writeResult(funcName, chain, err)
+		},
+	}
+
+	funcCmd.Flags().Int("offset", -1,
+		"byte `offset` of the cursor in the file (FILE_QUERY is then a file name)")
+	funcCmd.Flags().Bool("prefer-preceding", false,
+		"if the position is not within a function return the nearest preceding function")
+	funcCmd.Flags().Bool("from-diff", false,
+		"print the functions containing the lines changed by the unified diff read\n"+
+			"from stdin")
+	funcCmd.Flags().String("range", "",
+		"print the functions overlapping the range START_LINE:START_COL-END_LINE:END_COL\n"+
+			"(inclusive) of the file FILE_QUERY")
+	funcCmd.Flags().Bool("json-errors", false,
+		"report all errors, such as an invalid query or missing file, in the \"error\"\n"+
+			"field of the JSON result and exit 0")
+
+	testsForCmd := cobra.Command{
+		Use:   "tests-for FILE:LINE",
+		Short: "Print the tests that cover the source line FILE:LINE",
+		Long: "Print the tests that cover the source line FILE:LINE according to the\n" +
+			"coverage profile given by --coverprofile-in.\n\n" +
+			"The profile must be in the \"go test -coverprofile\" format with each\n" +
+			"test's blocks preceded by a \"# test: NAME\" line. Profiles for multiple\n" +
+			"tests may be concatenated.",
+		Example: fmt.Sprintf("%s tests-for --coverprofile-in cover.out ./main.go:12",
+			filepath.Base(os.Args[0])),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			profile, err := cmd.Flags().GetString("coverprofile-in")
+			if err != nil {
+				return err // should never happen
+			}
+			if profile == "" {
+				return errors.New("tests-for: the --coverprofile-in flag is required")
+			}
+			pos, err := ParseFileLineQuery(args[0])
+			if err != nil {
+				return err
+			}
+			filename, err := filepath.Abs(pos.Filename)
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(profile)
+			if err != nil {
+				return err
+			}
+			blocks, err := ParseTestCoverProfile(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+			return newEncoder(stdout).Encode(struct {
+				Filename string   `json:"filename"`
+				Line     int      `json:"line"`
+				Tests    []string `json:"tests"`
+			}{filename, pos.Line, TestsCoveringLine(blocks, filename, pos.Line)})
+		},
+	}
+	testsForCmd.Flags().String("coverprofile-in", "",
+		"coverage profile annotated with the test that produced each block")
+
+	testNameCmd := cobra.Command{
+		Use:   "testname FILE_QUERY",
+		Short: "Print the test containing the cursor and the pattern that runs it",
+		Long: "Print the test, benchmark, example or fuzz target containing the cursor\n" +
+			"at FILE_QUERY (FILE:LINE:COLUMN or FILE:#OFFSET) and the go test -run\n" +
+			"(or -bench) pattern that selects exactly it. If the cursor is within a\n" +
+			"subtest run with t.Run the pattern selects the subtest.",
+		Example: fmt.Sprintf("%s testname ./foo_test.go:12:8", filepath.Base(os.Args[0])),
+		Args:    cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			pos, err := ParseFileQuery(args[0])
+			if err != nil {
+				return err
+			}
+			src, err := readFile(ctxt, pos.Filename)
+			if err != nil {
+				return err
+			}
+			tn, err := TestNameAt(pos, src)
+			if err != nil {
+				return err
+			}
+			return newEncoder(stdout).Encode(tn)
+		},
 	}
 
-	name := s[:i]
-	return &token.Position{Filename: name, Line: line, Column: col}, nil
-}
+	unescapePathCmd := cobra.Command{
+		Use:   "unescape-path NAME...",
+		Short: "Print the package directories of escaped test binary names",
+		Long: "Print the package directory of each test binary name NAME, as\n" +
+			"reported by list --include-binary-names. Names that were hashed, since\n" +
+			"they were too long, cannot be reversed and are reported with an error.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			type unescaped struct {
+				Name  string `json:"name"`
+				Path  string `json:"path,omitempty"`
+				Error string `json:"error,omitempty"`
+			}
+			results := make([]unescaped, len(args))
+			for i, name := range args {
+				results[i].Name = name
+				path, err := unescapePath(name)
+				if err != nil {
+					results[i].Error = err.Error()
+				} else {
+					results[i].Path = filepath.FromSlash(path)
+				}
+			}
+			return newEncoder(stdout).Encode(results)
+		},
+	}
 
-// // WARN: use or remove
-// type ErrorWriter struct {
-// 	w io.Writer
-// }
-//
-// // WARN: use or remove
-// func (e *ErrorWriter) Write(p []byte) (int, error) {
-// 	json.NewEncoder(e.w).Encode(struct {
-// 		Error string `json:"error"`
-// 	}{string(p)})
-// 	return len(p), nil
-// }
+	runPatternCmd := cobra.Command{
+		Use:   "run-pattern [FILE]",
+		Short: "Print the go test -run pattern that matches exactly one test",
+		Long: "Print the go test -run pattern that matches exactly the test given by\n" +
+			"--name and, optionally, its subtest given by --subtest.\n\n" +
+			"If FILE is provided the tests of its package are listed and a warning\n" +
+			"is included if the test does not exist. A pattern is always printed.",
+		Example: fmt.Sprintf("%s run-pattern --name TestFoo --subtest \"my case\"",
+			filepath.Base(os.Args[0])),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			name, err := cmd.Flags().GetString("name")
+			if err != nil {
+				return err // should never happen
+			}
+			subtest, err := cmd.Flags().GetString("subtest")
+			if err != nil {
+				return err // should never happen
+			}
+			if name == "" {
+				return errors.New("run-pattern: the --name flag is required")
+			}
 
-type OverlayJSON struct {
-	Replace map[string]string `json:"replace"`
-}
+			var warnings []string
+			if len(args) == 1 {
+				ctxt, err = MatchContext(ctxt, args[0])
+				if err != nil {
+					return err
+				}
+				dirname, err := filepath.Abs(filepath.Dir(args[0]))
+				if err != nil {
+					return err
+				}
+				res, err := ListTests(ctxt, dirname, nil)
+				if err != nil {
+					return err
+				}
+				if !res.HasFunc(name) {
+					warnings = append(warnings, fmt.Sprintf(
+						"%s: not found in package %s", name, res.PkgName))
+				}
+			}
 
-// WARN: remove if not used
-func isFile(ctxt *build.Context, name string) bool {
-	if ctxt != nil && ctxt.OpenFile != nil {
-		f, err := ctxt.OpenFile(name)
-		if err != nil {
-			return false
-		}
-		f.Close()
-		return true
+			return newEncoder(stdout).Encode(struct {
+				Pattern  string   `json:"pattern"`
+				Warnings []string `json:"warnings,omitempty"`
+			}{RunPattern(name, subtest), warnings})
+		},
 	}
-	fi, err := os.Stat(name)
-	return err == nil && fi.Mode().IsRegular()
-}
-
-func main() {
-	ctxt := CopyContext(&build.Default)
-	ctxt.HasSubdir = contextutil.HasSubdirFunc(ctxt)
+	runPatternCmd.Flags().String("name", "", "name of the test, benchmark, example or fuzz target")
+	runPatternCmd.Flags().String("subtest", "", "name of the subtest")
+
+	testForCmd := cobra.Command{
+		Use:   "test-for FILE_QUERY",
+		Short: "Print the tests of the function or method containing the cursor",
+		Long: "Print the tests that, by naming convention, test the function or\n" +
+			"method containing the cursor ranked by the specificity of their name\n" +
+			"(a lower rank is more specific). For a method T.Foo the names\n" +
+			"TestT_Foo and Test_T_Foo rank highest followed by TestFoo and then\n" +
+			"tests prefixed with those names, such as TestFoo_EdgeCase.",
+		Example: fmt.Sprintf("%s test-for ./main.go:12:8", filepath.Base(os.Args[0])),
+		Args:    cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) (err error) {
+			pos, err := ParseFileQuery(args[0])
+			if err != nil {
+				return err
+			}
+			src, err := readFile(ctxt, pos.Filename)
+			if err != nil {
+				return err
+			}
+			d, err := containingFuncDeclPos(pos, src, false)
+			if err != nil {
+				return err
+			}
 
-	root := cobra.Command{
-		Use: "gotest-util",
-		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
-			overlay, err := cmd.Flags().GetString("overlay")
+			ctxt, err = MatchContext(ctxt, pos.Filename)
 			if err != nil {
-				return err // should never happen
+				return err
 			}
-			if strings.TrimSpace(overlay) == "" {
-				return nil
+			dirname, err := filepath.Abs(filepath.Dir(pos.Filename))
+			if err != nil {
+				return err
 			}
-			var o OverlayJSON
-			dec := json.NewDecoder(strings.NewReader(overlay))
-			dec.DisallowUnknownFields()
-			if err := dec.Decode(&o); err != nil {
+			res, err := ListTests(ctxt, dirname, &ListOptions{NoEnv: true})
+			if err != nil {
 				return err
 			}
-			if len(o.Replace) > 0 {
-				ctxt = OverlayContext(ctxt, o.Replace)
+
+			name := d.Name.Name
+			if recv := recvTypeName(d); recv != "" {
+				name = recv + "." + name
 			}
-			return nil
+			matches := FindTestsFor(d, res.Tests)
+			if matches == nil {
+				matches = []TestMatch{}
+			}
+			return newEncoder(stdout).Encode(struct {
+				Name  string      `json:"name"`
+				Tests []TestMatch `json:"tests"`
+			}{name, matches})
 		},
 	}
-	root.SilenceUsage = true
 
-	// TODO: create Context from flags
-	flags := root.PersistentFlags()
-	flags.String("tags", "", "build tags")
-	flags.String("overlay", "",
-		"read a JSON config file that provides an overlay for build operations")
-	flags.Bool("race", false, "enable race detection")
+	manifestCmd := cobra.Command{
+		Use:   "manifest [DIR]",
+		Short: "Print a manifest of every runnable test, benchmark and fuzz target",
+		Long: "Print a manifest of the runnable tests, benchmarks and fuzz targets of\n" +
+			"every package beneath DIR (default \".\") keyed by import path. Each\n" +
+			"target includes the pattern that selects exactly it. The output is\n" +
+			"deterministic.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			root := "."
+			if len(args) == 1 {
+				root = args[0]
+			}
+			root, err := filepath.Abs(root)
+			if err != nil {
+				return err
+			}
+			m, err := BuildManifest(cmd.Context(), ctxt, root)
+			if err != nil {
+				return err
+			}
+			return newEncoder(stdout).Encode(m)
+		},
+	}
+
+	runCmd := cobra.Command{
+		Use:   "run [FILE] [-- go test flags]",
+		Short: "Run the tests of a package and print their events",
+		Long: "Run the tests of the package containing FILE (or the directory FILE,\n" +
+			"or the current directory) with \"go test -json\" and print each test\n" +
+			"event as a line of JSON as it occurs. The build context is matched to\n" +
+			"FILE and the --race, --tags, --overlay, --buildmode and --mod flags\n" +
+			"are passed to go test along with any flags following \"--\".\n\n" +
+			"The exit code is 2 if any tests failed and 3 if they could not be built.",
+		Example: fmt.Sprintf("%s run ./foo_test.go --run TestFoo -- -count=1",
+			filepath.Base(os.Args[0])),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if n := cmd.ArgsLenAtDash(); n > 1 || (n == -1 && len(args) > 1) {
+				return fmt.Errorf("accepts at most 1 arg(s) before \"--\", received %d", len(args))
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var testArgs []string
+			if n := cmd.ArgsLenAtDash(); n != -1 {
+				args, testArgs = args[:n], args[n:]
+			}
 
-	listCmd := cobra.Command{
-		Use:   "list [FILE]",
-		Short: "List runnable Go tests",
-		Args:  cobra.MaximumNArgs(1),
-		RunE: func(_ *cobra.Command, args []string) (err error) {
 			dirname := "."
-			// If a file is provided match the context to it.
 			if len(args) == 1 {
-				dirname = filepath.Dir(args[0])
-				ctxt, err = MatchContext(ctxt, args[0])
+				dirname = args[0]
+				fi, err := os.Stat(dirname)
 				if err != nil {
 					return err
 				}
+				if !fi.IsDir() {
+					ctxt, err = MatchContext(ctxt, dirname)
+					if err != nil {
+						return err
+					}
+					dirname = filepath.Dir(dirname)
+				}
 			}
 			dirname, err = filepath.Abs(dirname)
 			if err != nil {
 				return err
 			}
 
-			defs, err := ListTests(ctxt, dirname)
+			flags := cmd.Flags()
+			goArgs := testConfig.Args()
+			tags, err := flags.GetString("tags")
 			if err != nil {
-				return err
+				return err // should never happen
+			}
+			if tags != "" {
+				goArgs = append(goArgs, "-tags="+tags)
+			}
+			buildmode, err := flags.GetString("buildmode")
+			if err != nil {
+				return err // should never happen
+			}
+			if buildmode != "" {
+				goArgs = append(goArgs, "-buildmode="+buildmode)
+			}
+			if flags.Changed("timeout") || timeout > 0 {
+				goArgs = append(goArgs, "-timeout="+timeout.String())
+			}
+			if len(overlayFiles) != 0 {
+				name, cleanup, err := writeGoOverlay(overlayFiles)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				goArgs = append(goArgs, "-overlay="+name)
+			}
+			run, err := flags.GetString("run")
+			if err != nil {
+				return err // should never happen
+			}
+			example, err := flags.GetString("example")
+			if err != nil {
+				return err // should never happen
+			}
+			if example != "" {
+				if run != "" {
+					return errors.New("run: --example and --run are mutually exclusive")
+				}
+				run = RunPattern(example, "")
+			}
+			if run != "" {
+				goArgs = append(goArgs, "-run="+run)
+			}
+			shuffle, err := flags.GetString("shuffle")
+			if err != nil {
+				return err // should never happen
+			}
+			if shuffle != "" {
+				arg, err := shuffleFlag(shuffle)
+				if err != nil {
+					return err
+				}
+				goArgs = append(goArgs, arg)
+			}
+			summary, err := flags.GetBool("summary")
+			if err != nil {
+				return err // should never happen
+			}
+			// The output mismatch of an example is reported by the summary.
+			summary = summary || example != ""
+			tree, err := flags.GetBool("tree")
+			if err != nil {
+				return err // should never happen
+			}
+			compressed, err := flags.GetBool("gzip")
+			if err != nil {
+				return err // should never happen
+			}
+			goArgs = append(goArgs, testArgs...)
+
+			showStderr, err := flags.GetBool("show-stderr")
+			if err != nil {
+				return err // should never happen
+			}
+			var teeStderr io.Writer
+			if showStderr {
+				teeStderr = os.Stderr
 			}
 
-			// WARN WARN WARN
-			// enc := json.NewEncoder(os.Stdout)
-			// enc.SetIndent("", "    ")
-			// return enc.Encode(defs)
-			// WARN WARN WARN
+			passthrough, err := flags.GetBool("passthrough")
+			if err != nil {
+				return err // should never happen
+			}
+			if passthrough {
+				if summary || tree {
+					return errors.New("run: --passthrough cannot be used with --summary, --tree or --example")
+				}
+				if compressed {
+					return errors.New("run: --passthrough cannot be used with --gzip")
+				}
+				err := passthroughTests(cmd.Context(), ctxt, dirname, goArgs...)
+				var eerr *ExitError
+				if errors.As(err, &eerr) {
+					// go test has already reported the failure.
+					cmd.SilenceErrors = true
+				}
+				return err
+			}
 
-			return json.NewEncoder(os.Stdout).Encode(defs)
+			var status runStatus
+			var events []Event
+			started := time.Now()
+			err = runTests(cmd.Context(), ctxt, dirname, teeStderr, func(e Event) error {
+				status.add(e)
+				if summary || tree {
+					events = append(events, e)
+					return nil
+				}
+				return streamJSON(e)
+			}, goArgs...)
+			var eerr error
+			switch {
+			case tree:
+				eerr = writeSummaryTree(stdout, Summarize(events), useColor(compressed))
+			case summary:
+				s := Summarize(events)
+				s.Timing = RunTiming(events, started)
+				eerr = newEncoder(stdout).Encode(s)
+			}
+			if eerr != nil && err == nil {
+				err = eerr
+			}
+			return status.exitError(err)
 		},
 	}
+	runCmd.Flags().String("run", "",
+		"only run tests matching `regexp` (passed to go test as -run)")
+	runCmd.Flags().Bool("passthrough", false,
+		"run go test without -json and copy its output to stdout and stderr as is,\n"+
+			"exiting with its exit code")
+	runCmd.Flags().String("example", "",
+		"only run the example `name` and print a summary that includes the\n"+
+			"got and want output if it fails")
+	runCmd.Flags().String("shuffle", "",
+		"randomize the order of tests: \"on\", \"off\" or a seed (passed to go test as -shuffle)\n"+
+			"the seed is reported in the \"-test.shuffle\" output event and the summary")
+	runCmd.Flags().Bool("show-stderr", false,
+		"copy the stderr of go test to stderr as it is written (it is always\n"+
+			"included in the error if go test fails)")
+	runCmd.Flags().Bool("summary", false,
+		"print a summary of the results, including the time spent building and\n"+
+			"running the tests, when the run completes instead of each event")
+	runCmd.Flags().Bool("tree", false,
+		"print the summary as a tree of packages, tests and subtests (colored if\n"+
+			"stdout is a terminal)")
+
+	parseJSONCmd := cobra.Command{
+		Use:   "parse-json [FILE]",
+		Short: "Summarize the output of \"go test -json\"",
+		Long: "Summarize the \"go test -json\" stream read from FILE, or stdin if no\n" +
+			"FILE is given. Lines that are not valid events are reported in the\n" +
+			"\"malformed\" field of the summary. With --events the decoded events\n" +
+			"are printed instead, one per line, and may be filtered by --action.",
+		Example: fmt.Sprintf("go test -json ./... | %s parse-json", filepath.Base(os.Args[0])),
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printEvents, err := cmd.Flags().GetBool("events")
+			if err != nil {
+				return err // should never happen
+			}
+			actions, err := cmd.Flags().GetStringSlice("action")
+			if err != nil {
+				return err // should never happen
+			}
+			tree, err := cmd.Flags().GetBool("tree")
+			if err != nil {
+				return err // should never happen
+			}
+			compressed, err := cmd.Flags().GetBool("gzip")
+			if err != nil {
+				return err // should never happen
+			}
 
-	envCmd := cobra.Command{
-		Use:     "env FILE",
-		Aliases: []string{"environment"},
-		Short:   "Print the Go environment matching FILE",
-		Args:    cobra.ExactArgs(1),
-		RunE: func(_ *cobra.Command, args []string) error {
-			ctxt, err := MatchContext(ctxt, args[0])
+			r := io.Reader(os.Stdin)
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			events, malformed, err := ParseEvents(r)
 			if err != nil {
 				return err
 			}
-			env := DiffGoEnv(&build.Default, ctxt)
-			return json.NewEncoder(os.Stdout).Encode(env)
+
+			if !printEvents {
+				sum := Summarize(events)
+				sum.Malformed = malformed
+				if tree {
+					return writeSummaryTree(stdout, sum, useColor(compressed))
+				}
+				return newEncoder(stdout).Encode(sum)
+			}
+			enc := json.NewEncoder(stdout)
+			for _, e := range events {
+				if len(actions) != 0 && !stringsContain(actions, e.Action) {
+					continue
+				}
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+			for _, m := range malformed {
+				fmt.Fprintf(os.Stderr, "warning: line %d: malformed event: %s\n", m.Line, m.Error)
+			}
+			return nil
 		},
 	}
-
-	funcCmd := cobra.Command{
-		Use:     "function FILE_QUERY",
-		Short:   "Print the function containing the cursor",
-		Example: fmt.Sprintf("%s function ./main.go:12:8", filepath.Base(os.Args[0])),
-		Args:    cobra.ExactArgs(1),
+	parseJSONCmd.Flags().Bool("events", false,
+		"print the decoded events instead of a summary")
+	parseJSONCmd.Flags().Bool("tree", false,
+		"print the summary as a tree of packages, tests and subtests (colored if\n"+
+			"stdout is a terminal)")
+	parseJSONCmd.Flags().StringSlice("action", nil,
+		"only print events with `action` (e.g. fail) (may be repeated)")
+
+	locateCmd := cobra.Command{
+		Use:   "locate TEST_NAME FILE_OR_DIR",
+		Short: "Print the declarations of a test across GOOS/GOARCH configurations",
+		Long: "Print every declaration of the test function TEST_NAME in the\n" +
+			"package's test files, grouped by the GOOS/GOARCH configurations that\n" +
+			"include them. This finds the platform specific variants of a test.\n" +
+			"If a file is given the configuration matching it is searched first.",
+		Example: fmt.Sprintf("%s locate TestOpen ./os", filepath.Base(os.Args[0])),
+		Args:    cobra.ExactArgs(2),
 		RunE: func(_ *cobra.Command, args []string) error {
-			pos, err := ParseFileQuery(args[0])
+			name, dirname := args[0], args[1]
+			fi, err := os.Stat(dirname)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				ctxt, err = MatchContext(ctxt, dirname)
+				if err != nil {
+					return err
+				}
+				dirname = filepath.Dir(dirname)
+			}
+			dirname, err = filepath.Abs(dirname)
+			if err != nil {
+				return err
+			}
+			results, err := Locate(ctxt, dirname, name)
 			if err != nil {
 				return err
 			}
+			if results == nil {
+				results = []LocateResult{}
+			}
+			return newEncoder(stdout).Encode(struct {
+				Name           string         `json:"name"`
+				Configurations []LocateResult `json:"configurations"`
+			}{name, results})
+		},
+	}
 
-			// Handle file overlays
-			var src []byte
-			f, err := util.OpenFile(ctxt, pos.Filename)
+	subtestsCmd := cobra.Command{
+		Use:   "subtests FILE_OR_DIR",
+		Short: "Print the subtests of a package with the -run pattern of each",
+		Long: "Print every subtest, run with t.Run, of the tests of the package\n" +
+			"containing FILE_OR_DIR as a flat list with the -run pattern that\n" +
+			"selects it. Names are rewritten and disambiguated (\"#01\") as they\n" +
+			"would be by the testing package. Names taken from table driven tests\n" +
+			"are marked \"inferred\" and names that could not be determined are\n" +
+			"marked \"dynamic\", whose pattern selects their closest known parent.\n" +
+			"Subtests are listed in the order they are declared, which is the\n" +
+			"order they run in, unless --sort-subtests=name is given.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			order, err := cmd.Flags().GetString("sort-subtests")
+			if err != nil {
+				return err // should never happen
+			}
+			dirname := args[0]
+			fi, err := os.Stat(dirname)
 			if err != nil {
 				return err
 			}
-			src, err = io.ReadAll(f)
-			f.Close()
+			if !fi.IsDir() {
+				ctxt, err = MatchContext(ctxt, dirname)
+				if err != nil {
+					return err
+				}
+				dirname = filepath.Dir(dirname)
+			}
+			dirname, err = filepath.Abs(dirname)
+			if err != nil {
+				return err
+			}
+			subtests, err := ListSubtests(ctxt, dirname, &ListOptions{
+				DeduplicateFiles: true,
+				NoEnv:            true,
+				SortSubtests:     order,
+			})
 			if err != nil {
 				return err
 			}
+			return newEncoder(stdout).Encode(struct {
+				Subtests []Subtest `json:"subtests"`
+			}{subtests})
+		},
+	}
 
-			// Return any error here as part of the JSON response.
-			funcName, err := ContainingFunction(pos.Filename, src, pos.Line, pos.Column)
-			var errMsg string
+	subtestsCmd.Flags().String("sort-subtests", subtestOrderPosition,
+		"order of the subtests: position (source and execution order) or name")
+
+	whichTest2JsonCmd := cobra.Command{
+		Use:   "which-test2json",
+		Short: "Print the path of the test2json executable used by run",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			exe, source, err := FindTest2Json(ctxt)
 			if err != nil {
-				errMsg = err.Error()
+				return err
 			}
-			return json.NewEncoder(os.Stdout).Encode(struct {
-				Name  string `json:"name"`
-				Error string `json:"error,omitempty"`
-			}{funcName, errMsg})
+			return newEncoder(stdout).Encode(struct {
+				Path   string `json:"path"`
+				Source string `json:"source"`
+				GOROOT string `json:"goroot"`
+			}{
+				Path:   exe,
+				Source: source,
+				GOROOT: ctxt.GOROOT,
+			})
 		},
 	}
 
@@ -659,14 +3983,39 @@ func main() {
 		Short: "Print the tool version and exit",
 		Args:  cobra.NoArgs,
 		RunE: func(_ *cobra.Command, _ []string) error {
-			_, err := fmt.Println(version)
+			_, err := fmt.Fprintln(stdout, version)
 			return err
 		},
 	}
 
-	root.AddCommand(&listCmd, &envCmd, &funcCmd, &versionCmd)
-
-	if err := root.Execute(); err != nil {
-		os.Exit(1)
+	root.AddCommand(&listCmd, &countCmd, &runCmd, &envCmd, &contextCmd, &funcCmd, &testsForCmd, &testForCmd,
+		&testNameCmd, &subtestsCmd, &runPatternCmd, &unescapePathCmd, &manifestCmd, &locateCmd, &parseJSONCmd, &whichTest2JsonCmd, &versionCmd)
+
+	// Cancel long running operations on interrupt. The signal handler is
+	// removed once the context is cancelled so that a second interrupt
+	// terminates the process immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := root.ExecuteContext(ctx)
+	cancelTimeout()
+	stop()
+	if cerr := closeOutput(); cerr != nil {
+		fmt.Fprintln(os.Stderr, "Error:", cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	if perr := stopProfiling(); perr != nil {
+		fmt.Fprintln(os.Stderr, "Error:", perr)
+		if err == nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		os.Exit(exitCode(err))
 	}
 }
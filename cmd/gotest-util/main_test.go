@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureStdout replaces os.Stdout with a pipe, which is returned, and
+// buffers output to it (see bufferOutput) until the test completes.
+func captureStdout(t *testing.T, compress bool) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdout, origOut := os.Stdout, stdout
+	origFlush, origClose := flushOutput, closeOutput
+	t.Cleanup(func() {
+		os.Stdout, stdout = origStdout, origOut
+		flushOutput, closeOutput = origFlush, origClose
+		w.Close()
+		r.Close()
+	})
+	os.Stdout = w
+	bufferOutput(compress)
+	return r
+}
+
+func TestStreamJSON(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		compress := compress
+		name := "plain"
+		if compress {
+			name = "gzip"
+		}
+		t.Run(name, func(t *testing.T) {
+			testStreamJSON(t, compress)
+		})
+	}
+}
+
+func testStreamJSON(t *testing.T, compress bool) {
+	r := captureStdout(t, compress)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		var rd io.Reader = r
+		if compress {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return
+			}
+			rd = zr
+		}
+		br := bufio.NewReader(rd)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	// Each object must be readable before the next one is written and
+	// without closing the output.
+	for i := 0; i < 3; i++ {
+		if err := streamJSON(map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("output closed before object %d", i)
+			}
+			var v map[string]int
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				t.Fatalf("invalid line %q: %v", line, err)
+			}
+			if v["n"] != i {
+				t.Errorf("got object %v want n=%d", v, i)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("object %d was not delivered", i)
+		}
+	}
+}
+
+// writeFiles writes files, keyed by their slash separated name, to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeModule writes files, keyed by their slash separated name, to a
+// temporary module named example.com/m and returns its directory.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/m\n\ngo 1.19\n"
+	writeFiles(t, dir, files)
+	return dir
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitSuccess},
+		{errors.New("usage"), ExitFailure},
+		{&ExitError{Code: ExitTestsFailed, Err: errors.New("fail")}, ExitTestsFailed},
+		{&ExitError{Code: ExitBuildFailed, Err: errors.New("build")}, ExitBuildFailed},
+		{fmt.Errorf("wrapped: %w", &ExitError{Code: ExitTestsFailed, Err: errors.New("fail")}), ExitTestsFailed},
+		{context.Canceled, ExitFailure},
+	}
+	for _, test := range tests {
+		if got := exitCode(test.err); got != test.want {
+			t.Errorf("exitCode(%v) = %d; want: %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short: runs go test")
+	}
+	tests := []struct {
+		name string
+		src  string
+		want int
+	}{
+		{"pass", "func TestPass(t *testing.T) {}\n", ExitSuccess},
+		{"fail", "func TestFail(t *testing.T) { t.Fatal(\"fail\") }\n", ExitTestsFailed},
+		{"build", "func TestBuild(t *testing.T) { x := 1 }\n", ExitBuildFailed},
+		{"no tests", "", ExitSuccess},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeModule(t, map[string]string{
+				"m_test.go": "package m\n\nimport \"testing\"\n\nvar _ testing.T\n\n" + test.src,
+			})
+			var status runStatus
+			err := runTests(context.Background(), &build.Default, dir, nil, func(e Event) error {
+				status.add(e)
+				return nil
+			})
+			if got := exitCode(status.exitError(err)); got != test.want {
+				t.Errorf("exit code = %d; want: %d (error: %v)", got, test.want, err)
+			}
+		})
+	}
+}
+
+func TestContainingFuncTagExcluded(t *testing.T) {
+	const src = "//go:build integration\n\npackage m\n\nimport \"testing\"\n\nfunc TestTagged(t *testing.T) {\n\tt.Log(\"x\")\n}\n"
+	dir := writeModule(t, map[string]string{"tagged_test.go": src})
+	filename := filepath.Join(dir, "tagged_test.go")
+
+	ctxt := build.Default
+	if ok, err := ctxt.MatchFile(dir, "tagged_test.go"); err != nil || ok {
+		t.Fatalf("MatchFile = %t, %v; want the file to be excluded", ok, err)
+	}
+	data, err := readFile(&ctxt, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := &token.Position{Filename: filename, Line: 8, Column: 2}
+	d, err := containingFuncDeclPos(pos, data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name.Name != "TestTagged" {
+		t.Errorf("containingFuncDeclPos = %s; want: TestTagged", d.Name.Name)
+	}
+}
+
+// gopathContext returns a copy of build.Default with GOPATH set to the
+// elements of gopath.
+func gopathContext(gopath ...string) *build.Context {
+	ctxt := build.Default
+	ctxt.GOPATH = strings.Join(gopath, string(filepath.ListSeparator))
+	return &ctxt
+}
+
+func TestListTestsMultiEntryGOPATH(t *testing.T) {
+	gp1, gp2 := t.TempDir(), t.TempDir()
+	writeFiles(t, gp1, map[string]string{"src/example.com/other/o.go": "package other\n"})
+	writeFiles(t, gp2, map[string]string{
+		"src/example.com/p/p_test.go": "package p\n\nimport \"testing\"\n\nfunc TestP(t *testing.T) {}\n",
+	})
+	ctxt := gopathContext(gp1, gp2)
+	res, err := ListTests(ctxt, filepath.Join(gp2, "src", "example.com", "p"), &ListOptions{NoEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(gp2, "src"); res.PkgRoot != want {
+		t.Errorf("PkgRoot = %q; want: %q", res.PkgRoot, want)
+	}
+	if res.ImportPath != "example.com/p" {
+		t.Errorf("ImportPath = %q; want: %q", res.ImportPath, "example.com/p")
+	}
+}
+
+func TestGopathEqual(t *testing.T) {
+	sep := string(filepath.ListSeparator)
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"/a" + sep + "/b", "/a" + sep + "/b", true},
+		{"/a" + sep + "/b", "/a/" + sep + sep + "/b", true},
+		{"/a" + sep + "/b", "/b" + sep + "/a", false},
+		{"/a" + sep + "/b", "/a", false},
+	}
+	for _, test := range tests {
+		a, b := gopathContext(test.a), gopathContext(test.b)
+		if got := gopathEqual(a, b); got != test.want {
+			t.Errorf("gopathEqual(%q, %q) = %t; want: %t", test.a, test.b, got, test.want)
+		}
+		if diff := DiffGoEnv(a, b); (diff.GoPath == nil) != test.want {
+			t.Errorf("DiffGoEnv(%q, %q).GoPath = %v; want changed: %t", test.a, test.b, diff.GoPath, !test.want)
+		}
+	}
+}
+
+func TestListTestsRecursiveInterrupted(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"a/a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n",
+		"b/b_test.go": "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n",
+	})
+	res, err := ListTestsRecursive(context.Background(), &build.Default, dir, &ListOptions{NoEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Interrupted || len(res.Packages) != 2 {
+		t.Errorf("got %d packages (interrupted: %t); want: 2", len(res.Packages), res.Interrupted)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err = ListTestsRecursive(ctx, &build.Default, dir, &ListOptions{NoEnv: true})
+	if err != nil {
+		t.Fatalf("a cancelled list should return partial results, got: %v", err)
+	}
+	if !res.Interrupted {
+		t.Error("Interrupted = false; want: true")
+	}
+	if res.Packages == nil {
+		t.Error("Packages = nil; want the (possibly empty) partial results")
+	}
+}
+
+func TestListTestsGOROOT(t *testing.T) {
+	dir := filepath.Join(build.Default.GOROOT, "src", "strings")
+	if _, err := os.Stat(dir); err != nil {
+		t.Skip("GOROOT source is not available:", err)
+	}
+	res, err := ListTests(&build.Default, dir, &ListOptions{NoEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ImportPath != "strings" {
+		t.Errorf("ImportPath = %q; want: %q", res.ImportPath, "strings")
+	}
+	if !res.Goroot {
+		t.Error("Goroot = false; want: true")
+	}
+	if want := filepath.Join(build.Default.GOROOT, "src"); res.PkgRoot != want {
+		t.Errorf("PkgRoot = %q; want: %q", res.PkgRoot, want)
+	}
+	if len(res.Tests) == 0 {
+		t.Error("no tests were listed")
+	}
+}
+
+func TestPackageRootGOPATH(t *testing.T) {
+	gopath := t.TempDir()
+	writeFiles(t, gopath, map[string]string{
+		"src/example.com/a/b/b_test.go": "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n",
+	})
+	ctxt := gopathContext(gopath)
+	src := filepath.Join(gopath, "src")
+	dir := filepath.Join(src, "example.com", "a", "b")
+	if got := packageRoot(ctxt, dir); got != src {
+		t.Errorf("packageRoot(%q) = %q; want: %q", dir, got, src)
+	}
+	res, err := ListTests(ctxt, dir, &ListOptions{NoEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PkgRoot != src || res.ImportPath != "example.com/a/b" {
+		t.Errorf("PkgRoot, ImportPath = %q, %q; want: %q, %q", res.PkgRoot, res.ImportPath, src, "example.com/a/b")
+	}
+
+	// Directories outside of the GOPATH are their own root.
+	other := t.TempDir()
+	if got := packageRoot(ctxt, other); got != other {
+		t.Errorf("packageRoot(%q) = %q; want: %q", other, got, other)
+	}
+}
+
+func TestListTestsDeterministic(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("a%d_test.go", i)] = fmt.Sprintf(`package m
+
+import "testing"
+
+func TestZ%[1]d(t *testing.T) {
+	t.Run("b", func(t *testing.T) {})
+	t.Run("a", func(t *testing.T) {})
+}
+
+func TestA%[1]d(t *testing.T) {}
+
+func BenchmarkB%[1]d(b *testing.B) {}
+
+func ExampleE%[1]d() {}
+`, i)
+	}
+	files["sub/s_test.go"] = "package sub\n\nimport \"testing\"\n\nfunc TestSub(t *testing.T) {}\n"
+	dir := writeModule(t, files)
+
+	opts := &ListOptions{
+		NoEnv:              true,
+		Subtests:           true,
+		GoTestNames:        true,
+		Signatures:         true,
+		FlakyHeuristics:    true,
+		IncludeConstraints: true,
+	}
+	list := func() []byte {
+		res, err := ListTests(&build.Default, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := ListTestsRecursive(context.Background(), &build.Default, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal([]interface{}{res, rec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	want := list()
+	for i := 0; i < 10; i++ {
+		if got := list(); string(got) != string(want) {
+			t.Fatalf("run %d: output differs:\ngot:  %s\nwant: %s", i, got, want)
+		}
+	}
+}
+
+func TestCountTestsSubtests(t *testing.T) {
+	dir := writeModule(t, map[string]string{"m_test.go": `package m
+
+import "testing"
+
+func TestTable(t *testing.T) {
+	tests := []struct {
+		name string
+	}{
+		{"a"},
+		{"b"},
+		{"c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {})
+	}
+}
+
+func TestNested(t *testing.T) {
+	t.Run("outer", func(t *testing.T) {
+		t.Run("inner", func(t *testing.T) {})
+	})
+}
+
+func TestNone(t *testing.T) {}
+
+func BenchmarkSub(b *testing.B) {
+	b.Run("sub", func(b *testing.B) {})
+}
+`})
+	counts, err := CountTests(&build.Default, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TestCounts{TestFiles: 1, Tests: 3, Benchmarks: 1, Subtests: 5}
+	if *counts != want {
+		t.Errorf("CountTests() = %+v; want: %+v", *counts, want)
+	}
+
+	counts, err = CountTests(&build.Default, dir, &ListOptions{Kinds: []string{"benchmark"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Subtests != 0 {
+		t.Errorf("CountTests(benchmark).Subtests = %d; want: 0", counts.Subtests)
+	}
+}
+
+func TestDedupFiles(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"a_test.go": "package m\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n",
+	})
+	if err := os.Symlink("a_test.go", filepath.Join(dir, "link_test.go")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	names := []string{"a_test.go", "link_test.go", "overlay_test.go"}
+
+	uniq, aliases := dedupFiles(&build.Default, dir, names)
+	if want := []string{"a_test.go", "overlay_test.go"}; !reflect.DeepEqual(uniq, want) {
+		t.Errorf("dedupFiles() = %q; want: %q", uniq, want)
+	}
+	if want := map[string][]string{"a_test.go": {"link_test.go"}}; !reflect.DeepEqual(aliases, want) {
+		t.Errorf("dedupFiles() aliases = %q; want: %q", aliases, want)
+	}
+
+	// An overlay that shadows the symlink is a distinct file and a file
+	// that only exists in the overlay is retained.
+	ctxt := OverlayContext(&build.Default, map[string]string{
+		filepath.Join(dir, "link_test.go"):    "package m\n",
+		filepath.Join(dir, "overlay_test.go"): "package m\n",
+	})
+	uniq, aliases = dedupFiles(ctxt, dir, names)
+	if !reflect.DeepEqual(uniq, names) || aliases != nil {
+		t.Errorf("dedupFiles(overlay) = %q, %q; want: %q, nil", uniq, aliases, names)
+	}
+
+	for _, report := range []bool{false, true} {
+		res, err := ListTests(&build.Default, dir, &ListOptions{
+			NoEnv:            true,
+			DeduplicateFiles: true,
+			ReportAliases:    report,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Tests) != 1 {
+			t.Errorf("ReportAliases=%t: got %d tests; want: 1", report, len(res.Tests))
+		}
+		if got := res.Aliases != nil; got != report {
+			t.Errorf("ReportAliases=%t: Aliases = %q", report, res.Aliases)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// makeTargetReplacer escapes the characters that are special in the target
+// names of a Makefile rule.
+var makeTargetReplacer = strings.NewReplacer(
+	" ", "_",
+	"\t", "_",
+	":", "_",
+	"#", "_",
+	"%", "_",
+	"=", "_",
+	";", "_",
+	"$", "$$",
+)
+
+// makeTarget returns the Makefile target name for the function name with
+// prefix.
+func makeTarget(prefix, name string) string {
+	return makeTargetReplacer.Replace(prefix + name)
+}
+
+// makeRecipe escapes the variable references in the shell command s so that
+// it can be used as the recipe of a Makefile rule.
+func makeRecipe(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// writeMakefile writes a Makefile fragment with a phony target that runs
+// each of the tests ("test-NAME"), benchmarks ("bench-NAME") and fuzz
+// targets ("fuzz-NAME") of res. The package directory is dir.
+func writeMakefile(w io.Writer, res *ListTestsResponse, dir string) error {
+	cd := "cd " + shellQuote(dir) + " && "
+	rules := []struct {
+		prefix string
+		flags  string
+		defs   []*FuncDefinition
+	}{
+		{"test-", "-run", res.Tests},
+		{"bench-", "-run '^$$' -bench", res.Benchmarks},
+		{"fuzz-", "-run '^$$' -fuzz", res.Fuzz},
+	}
+	for _, r := range rules {
+		for _, def := range r.defs {
+			target := makeTarget(r.prefix, def.Name)
+			_, err := fmt.Fprintf(w, ".PHONY: %[1]s\n%[1]s:\n\t%[2]sgo test %[3]s %[4]s .\n\n",
+				target, makeRecipe(cd), r.flags, makeRecipe(shellQuote(RunPattern(def.Name, ""))))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
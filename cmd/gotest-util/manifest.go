@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A Target is a runnable test, benchmark or fuzz target and the pattern
+// that selects exactly it (to be passed to -run, -bench or -fuzz).
+type Target struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// A ManifestPackage lists the runnable targets of a package.
+type ManifestPackage struct {
+	Dir        string   `json:"dir"`
+	Tests      []Target `json:"tests,omitempty"`
+	Benchmarks []Target `json:"benchmarks,omitempty"`
+	Fuzz       []Target `json:"fuzz,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// A Manifest lists every runnable target beneath a directory keyed by
+// import path (or directory if the import path cannot be determined).
+type Manifest struct {
+	Module     string                      `json:"module,omitempty"`
+	ModuleRoot string                      `json:"module_root,omitempty"`
+	Workspace  string                      `json:"workspace,omitempty"`
+	Packages   map[string]*ManifestPackage `json:"packages"`
+
+	// Interrupted is set if discovery was cancelled and the manifest
+	// is incomplete.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+func targets(defs []*FuncDefinition) []Target {
+	if len(defs) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(defs))
+	a := make([]Target, 0, len(defs))
+	for _, d := range defs {
+		if !seen[d.Name] {
+			seen[d.Name] = true
+			a = append(a, Target{Name: d.Name, Pattern: RunPattern(d.Name, "")})
+		}
+	}
+	sort.Slice(a, func(i, j int) bool {
+		return a[i].Name < a[j].Name
+	})
+	return a
+}
+
+// BuildManifest discovers the runnable targets of every package beneath
+// root. Packages that fail to load are included with their error and those
+// without any targets are omitted. If ctx is cancelled the partial manifest
+// is returned with Interrupted set.
+func BuildManifest(ctx context.Context, ctxt *build.Context, root string) (*Manifest, error) {
+	m := &Manifest{Packages: make(map[string]*ManifestPackage)}
+	if gomod, ok := findParentFile(root, "go.mod"); ok {
+		if data, err := os.ReadFile(gomod); err == nil {
+			m.Module = modulePath(data)
+			m.ModuleRoot = filepath.Dir(gomod)
+		}
+	}
+	if gowork, ok := findParentFile(root, "go.work"); ok {
+		m.Workspace = gowork
+	}
+
+	err := walkPackageDirs(ctx, root, func(dir string, _ []string) error {
+		key, ok := moduleImportPath(dir)
+		if !ok {
+			key = dir
+		}
+		res, err := ListTests(ctxt, dir, &ListOptions{DeduplicateFiles: true})
+		if err != nil {
+			m.Packages[key] = &ManifestPackage{Dir: dir, Error: err.Error()}
+			return nil
+		}
+		p := &ManifestPackage{
+			Dir:        dir,
+			Tests:      targets(res.Tests),
+			Benchmarks: targets(res.Benchmarks),
+			Fuzz:       targets(res.Fuzz),
+		}
+		if len(p.Tests) != 0 || len(p.Benchmarks) != 0 || len(p.Fuzz) != 0 {
+			m.Packages[key] = p
+		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			m.Interrupted = true
+			return m, nil
+		}
+		return nil, err
+	}
+	return m, nil
+}
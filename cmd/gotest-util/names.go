@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// rewriteSubtestName rewrites a subtest name the way the testing package
+// does when forming the test's full name: spaces are replaced with
+// underscores and non-printable runes are escaped.
+func rewriteSubtestName(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			b.WriteByte('_')
+		case !strconv.IsPrint(r):
+			s := strconv.QuoteRune(r)
+			b.WriteString(s[1 : len(s)-1])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// anchorName returns a regexp that exactly matches name.
+func anchorName(name string) string {
+	return "^" + regexp.QuoteMeta(name) + "$"
+}
+
+// RunPattern returns the "go test -run" pattern that matches exactly the
+// test named name and, if provided, its subtest. The subtest name is
+// rewritten as it would be by the testing package and, like "go test",
+// is split into levels on "/".
+func RunPattern(name, subtest string) string {
+	if subtest == "" {
+		return anchorName(name)
+	}
+	return fullNamePattern(name + "/" + rewriteSubtestName(subtest))
+}
+
+// fullNamePattern returns the "go test -run" pattern that matches exactly
+// the test with full name fullName, such as "TestFoo/a_b#01", which has
+// already been rewritten by the testing package.
+func fullNamePattern(fullName string) string {
+	levels := strings.Split(fullName, "/")
+	for i, s := range levels {
+		levels[i] = anchorName(s)
+	}
+	return strings.Join(levels, "/")
+}
+
+// A subtestNamer assigns the unique full names given to subtests by the
+// testing package: the names of subtests run more than once by the same
+// parent are suffixed with "#01", "#02" and so on, and empty names are
+// replaced with "#00".
+type subtestNamer struct {
+	used map[string]int // full name => next suffix
+}
+
+// unique returns the full name of subtest name of the test with full name
+// parent.
+func (n *subtestNamer) unique(parent, name string) string {
+	if n.used == nil {
+		n.used = make(map[string]int)
+	}
+	full := parent + "/" + rewriteSubtestName(name)
+	empty := name == ""
+	for {
+		next, exists := n.used[full]
+		if !empty && !exists {
+			n.used[full] = 1
+			return full
+		}
+		n.used[full] = next + 1
+		full = fmt.Sprintf("%s#%02d", full, next)
+		empty = false
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"go/build"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteSubtestName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"a", "a"},
+		{"a b", "a_b"},
+		{"a\tb\nc", "a_b_c"},
+		{"a\x00b", `a\x00b`},
+		{"ünïcode", "ünïcode"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := rewriteSubtestName(test.name); got != test.want {
+			t.Errorf("rewriteSubtestName(%q) = %q; want: %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSubtestNamerUnique(t *testing.T) {
+	// The names, in order, given to the subtests run by TestFoo by the
+	// testing package.
+	names := []string{"a", "a", "a b", "a_b", "", "", "a#01", "a"}
+	want := []string{
+		"TestFoo/a",
+		"TestFoo/a#01",
+		"TestFoo/a_b",
+		"TestFoo/a_b#01",
+		"TestFoo/#00",
+		"TestFoo/#01",
+		"TestFoo/a#01#01",
+		"TestFoo/a#02",
+	}
+	var namer subtestNamer
+	var got []string
+	for _, name := range names {
+		got = append(got, namer.unique("TestFoo", name))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unique:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestGoTestNames(t *testing.T) {
+	dir := writeModule(t, map[string]string{"m_test.go": `package m
+
+import "testing"
+
+func TestFoo(t *testing.T) {
+	t.Run("a case", func(t *testing.T) {
+		t.Run("inner one", func(t *testing.T) {})
+	})
+	t.Run("a case", func(t *testing.T) {})
+	t.Run("", func(t *testing.T) {})
+}
+`})
+	res, err := ListTests(&build.Default, dir, &ListOptions{GoTestNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tests) != 1 {
+		t.Fatalf("got %d tests; want: 1", len(res.Tests))
+	}
+	def := res.Tests[0]
+	wantSubtests := []string{"a case", "a case/inner one", "a case", ""}
+	if !reflect.DeepEqual(def.Subtests, wantSubtests) {
+		t.Errorf("Subtests = %q; want: %q", def.Subtests, wantSubtests)
+	}
+	wantNames := []string{"TestFoo/a_case", "TestFoo/a_case/inner_one", "TestFoo/a_case#01", "TestFoo/#00"}
+	if !reflect.DeepEqual(def.GoTestNames, wantNames) {
+		t.Errorf("GoTestNames = %q; want: %q", def.GoTestNames, wantNames)
+	}
+
+	if testing.Short() {
+		return
+	}
+	// The names must be those reported by go test.
+	var run []string
+	err = runTests(context.Background(), &build.Default, dir, nil, func(e Event) error {
+		if e.Action == "run" && strings.Contains(e.Test, "/") {
+			run = append(run, e.Test)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(run, wantNames) {
+		t.Errorf("go test ran: %q; want: %q", run, wantNames)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	util "golang.org/x/tools/go/buildutil"
+)
+
+// A PackageClauseError is returned by ListTests when the Go files of a
+// directory disagree on their package name (other than the "_test" suffix
+// of external tests).
+type PackageClauseError struct {
+	Dir string
+
+	// Clauses maps the name of each Go file of Dir matched by the build
+	// context to the package name it declares.
+	Clauses map[string]string
+}
+
+func (e *PackageClauseError) Error() string {
+	files := make(map[string][]string)
+	for name, pkg := range e.Clauses {
+		files[pkg] = append(files[pkg], name)
+	}
+	pkgs := make([]string, 0, len(files))
+	for pkg := range files {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	var b strings.Builder
+	fmt.Fprintf(&b, "files in %s disagree on their package name: ", e.Dir)
+	for i, pkg := range pkgs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		sort.Strings(files[pkg])
+		fmt.Fprintf(&b, "%s (%s)", pkg, strings.Join(files[pkg], ", "))
+	}
+	return b.String()
+}
+
+// packageClauses returns the package names declared by the Go files of dir
+// that are matched by ctxt keyed by file name.
+func packageClauses(ctxt *build.Context, dir string) (map[string]string, error) {
+	names, err := goFileNames(ctxt, dir)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	clauses := make(map[string]string, len(names))
+	for _, name := range names {
+		if ok, err := ctxt.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		af, err := util.ParseFile(fset, ctxt, nil, dir, name, parser.PackageClauseOnly)
+		if af == nil {
+			return nil, err
+		}
+		// Like go/build, ignore files of package documentation.
+		if af.Name.Name != "documentation" {
+			clauses[name] = af.Name.Name
+		}
+	}
+	return clauses, nil
+}
+
+// packageClauseResponse returns the response and PackageClauseError of
+// directory dir, whose files declare multiple packages. The error err of
+// ImportDir is returned if the package clauses cannot be read.
+func packageClauseResponse(ctxt *build.Context, dir string, err error) (*ListTestsResponse, error) {
+	clauses, cerr := packageClauses(ctxt, dir)
+	if cerr != nil {
+		return nil, err
+	}
+	pkgRoot := packageRoot(ctxt, dir)
+	ipath, _ := moduleImportPath(dir)
+	goVersion, _ := goDirective(dir)
+	res := &ListTestsResponse{
+		PkgRoot:        pkgRoot,
+		ImportPath:     ipath,
+		InMainModule:   inMainModule(ctxt, dir),
+		GoDirective:    goVersion,
+		PackageClauses: clauses,
+	}
+	return res, &PackageClauseError{Dir: dir, Clauses: clauses}
+}
+
+// goFileNames returns the names of the Go files in dir.
+func goFileNames(ctxt *build.Context, dir string) ([]string, error) {
+	fis, err := util.ReadDir(ctxt, dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && filepath.Ext(fi.Name()) == ".go" {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,93 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processExited reports if the process pid has exited. Zombies, which may
+// not be reaped if this runs as PID 1 of a container, have exited.
+func processExited(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses.
+	if i := bytes.LastIndexByte(stat, ')'); i != -1 && i+2 < len(stat) {
+		return stat[i+2] == 'Z'
+	}
+	return false
+}
+
+func TestRunTestsCancelKillsTestBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short: runs go test")
+	}
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	dir := writeModule(t, map[string]string{"m_test.go": fmt.Sprintf(`package m
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSleep(t *testing.T) {
+	os.WriteFile(%q, []byte(strconv.Itoa(os.Getpid())), 0644)
+	time.Sleep(time.Minute)
+}
+`, pidFile)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- runTests(ctx, &build.Default, dir, nil, func(Event) error { return nil }, "-count=1")
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(time.Minute); pid == 0; {
+		if data, err := os.ReadFile(pidFile); err == nil && len(data) != 0 {
+			if pid, err = strconv.Atoi(string(data)); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the test binary to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("runTests() = %v; want: %v", err, context.Canceled)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("runTests did not return after it was cancelled")
+	}
+	for !processExited(pid) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("test binary %d is still running after the run was cancelled", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
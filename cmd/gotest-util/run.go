@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runStatus tracks the events of a test run to determine its exit code.
+type runStatus struct {
+	tests       int  // number of tests that completed
+	testFailed  bool // a test failed
+	buildFailed bool // a package failed to build
+}
+
+func (s *runStatus) add(e Event) {
+	switch e.Action {
+	case "pass", "fail", "skip":
+		if e.Test != "" {
+			s.tests++
+			if e.Action == "fail" {
+				s.testFailed = true
+			}
+		}
+	case "build-fail":
+		s.buildFailed = true
+	case "output":
+		if e.Output != nil && e.Test == "" &&
+			(strings.Contains(*e.Output, "[build failed]") ||
+				strings.Contains(*e.Output, "[setup failed]")) {
+			s.buildFailed = true
+		}
+	}
+}
+
+// exitError wraps the error of a run, if the go command failed, with the
+// code the tool should exit with: ExitBuildFailed if the tests could not be
+// built and ExitTestsFailed otherwise.
+func (s *runStatus) exitError(err error) error {
+	var eerr *exec.ExitError
+	if err == nil || !errors.As(err, &eerr) {
+		return err
+	}
+	if s.buildFailed || (!s.testFailed && s.tests == 0) {
+		return &ExitError{Code: ExitBuildFailed, Err: err}
+	}
+	return &ExitError{Code: ExitTestsFailed, Err: err}
+}
+
+// passthroughTests runs "go test" with args in directory dirname with its
+// stdin, stdout and stderr connected to those of this process. If go test
+// fails an ExitError with its exit code is returned. The test process group
+// is killed if ctx is cancelled.
+func passthroughTests(ctx context.Context, ctxt *build.Context, dirname string, args ...string) error {
+	if err := flushOutput(); err != nil {
+		return err
+	}
+	// See runTests for why ctx is not passed to the command.
+	cmd := goCommand(context.Background(), ctxt, dirname, append([]string{"test"}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err := cancelProcessGroup(ctx, cmd)()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var eerr *exec.ExitError
+	if errors.As(err, &eerr) && eerr.ExitCode() > 0 {
+		return &ExitError{Code: eerr.ExitCode(), Err: err}
+	}
+	return err
+}
+
+// writeGoOverlay writes the contents of overlay, which maps file names to
+// their contents, to a temporary directory along with a file that can be
+// passed to the go command's -overlay flag. The returned function removes
+// the temporary directory.
+func writeGoOverlay(overlay map[string]string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "gotest-util-overlay-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	replace := make(map[string]string, len(overlay))
+	i := 0
+	for filename, content := range overlay {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		// Use a directory per file so that the base name, which may imply
+		// build constraints, is kept.
+		dst := filepath.Join(dir, strconv.Itoa(i), filepath.Base(filename))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		if err := os.WriteFile(dst, []byte(content), 0644); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		replace[abs] = dst
+		i++
+	}
+
+	data, err := json.Marshal(struct {
+		Replace map[string]string
+	}{replace})
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	name := filepath.Join(dir, "overlay.json")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return name, cleanup, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SARIF 2.1.0 log types. Only the subset of the schema used to report the
+// findings of ListTests is defined.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version,omitempty"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// SARIF rule IDs of the findings reported by ListTests.
+const (
+	ruleParseError        = "parse-error"
+	ruleFlakyRisk         = "flaky-risk"
+	ruleWritesCWD         = "writes-cwd"
+	ruleMissingResetTimer = "missing-reset-timer"
+	ruleWritesPackageVars = "writes-package-vars"
+)
+
+var sarifRules = []sarifRule{
+	{ruleParseError, sarifMessage{"Test file could not be parsed"}},
+	{ruleFlakyRisk, sarifMessage{"Test depends on time, the network or randomness"}},
+	{ruleWritesCWD, sarifMessage{"Test writes files outside of a temporary directory"}},
+	{ruleMissingResetTimer, sarifMessage{"Benchmark setup is not excluded by b.ResetTimer"}},
+	{ruleWritesPackageVars, sarifMessage{"Test writes package level variables"}},
+}
+
+// sarifListOptions returns a copy of opts with the checks that are
+// reported by sarifReport enabled.
+func sarifListOptions(opts ListOptions) *ListOptions {
+	opts.FlakyHeuristics = true
+	opts.HermeticityCheck = true
+	opts.BenchmarkTimerCheck = true
+	opts.OrderDeps = true
+	opts.NoEnv = true
+	return &opts
+}
+
+// sarifReport returns a SARIF log of the parse errors and advisory findings
+// of res. File locations are relative to the package root (%SRCROOT%) when
+// possible.
+func sarifReport(res *ListTestsResponse) *sarifLog {
+	uri := func(filename string) sarifArtifactLocation {
+		if rel, err := filepath.Rel(res.PkgRoot, filename); err == nil &&
+			!strings.HasPrefix(rel, "..") {
+			return sarifArtifactLocation{URI: filepath.ToSlash(rel), URIBaseID: "%SRCROOT%"}
+		}
+		return sarifArtifactLocation{URI: "file://" + filepath.ToSlash(filename)}
+	}
+	results := []sarifResult{}
+	add := func(rule, level, msg, filename string, line, col int) {
+		loc := sarifPhysicalLocation{ArtifactLocation: uri(filename)}
+		if line > 0 {
+			loc.Region = &sarifRegion{StartLine: line, StartColumn: col}
+		}
+		results = append(results, sarifResult{
+			RuleID:    rule,
+			Level:     level,
+			Message:   sarifMessage{msg},
+			Locations: []sarifLocation{{loc}},
+		})
+	}
+
+	for _, e := range res.ParseErrors {
+		add(ruleParseError, "error", e.Message, e.Filename, e.Line, e.Column)
+	}
+	for _, defs := range [][]*FuncDefinition{res.Tests, res.Benchmarks, res.Examples, res.Fuzz} {
+		for _, d := range defs {
+			if len(d.FlakyRisk) != 0 {
+				add(ruleFlakyRisk, "note", fmt.Sprintf("%s may be flaky: uses %s",
+					d.Name, strings.Join(d.FlakyRisk, ", ")), d.Filename, d.Line, 0)
+			}
+			if d.WritesCWD {
+				add(ruleWritesCWD, "warning", fmt.Sprintf("%s writes files outside of a "+
+					"temporary directory", d.Name), d.Filename, d.WritesCWDLine, 0)
+			}
+			if d.MissingResetTimer {
+				add(ruleMissingResetTimer, "warning", fmt.Sprintf("%s performs setup "+
+					"before its loop without calling b.ResetTimer", d.Name), d.Filename, d.Line, 0)
+			}
+			if len(d.WritesPackageVars) != 0 {
+				add(ruleWritesPackageVars, "note", fmt.Sprintf("%s writes package level "+
+					"variables: %s", d.Name, strings.Join(d.WritesPackageVars, ", ")),
+					d.Filename, d.Line, 0)
+			}
+		}
+	}
+
+	return &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:    "gotest-util",
+				Version: version,
+				Rules:   sarifRules,
+			}},
+			Results: results,
+		}},
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// shuffleFlag returns the go test -shuffle flag for value s, which must be
+// "on", "off" or an integer seed.
+func shuffleFlag(s string) (string, error) {
+	switch s {
+	case "on", "off":
+	default:
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return "", fmt.Errorf("invalid -shuffle: %q: must be \"on\", \"off\" or an integer seed", s)
+		}
+	}
+	return "-shuffle=" + s, nil
+}
+
+// ShuffleSeed returns the seed used to shuffle the tests of a run, which
+// the testing package prints as "-test.shuffle SEED" before running the
+// tests. Passing the seed to -shuffle reproduces the order of the run.
+func ShuffleSeed(events []Event) (int64, bool) {
+	for _, e := range events {
+		if e.Output == nil {
+			continue
+		}
+		if seed, ok := parseShuffleSeed(*e.Output); ok {
+			return seed, true
+		}
+	}
+	return 0, false
+}
+
+func parseShuffleSeed(line string) (int64, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "-test.shuffle ") {
+		return 0, false
+	}
+	s := strings.TrimSpace(strings.TrimPrefix(line, "-test.shuffle "))
+	seed, err := strconv.ParseInt(s, 10, 64)
+	return seed, err == nil
+}
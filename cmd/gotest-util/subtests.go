@@ -0,0 +1,548 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+
+	util "golang.org/x/tools/go/buildutil"
+)
+
+// findSubtests returns the names of the subtests run by test d with t.Run.
+// Names are found for string literals and for table-driven tests that range
+// over a composite literal slice (or map) declared in the same file and
+// pass a string field of the element (or the map key) to t.Run. Names that
+// cannot be determined are reported as the name expression in braces, such
+// as "{tt.name}". Nested subtests are joined with '/'. The names are those
+// passed to t.Run, not the rewritten names reported by go test (see
+// rewriteSubtestName).
+func findSubtests(imports map[string]string, d *ast.FuncDecl) []string {
+	entries := subtestEntries(imports, d)
+	if len(entries) == 0 {
+		return nil
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = strings.Join(e.path, "/")
+	}
+	return names
+}
+
+// The source of the name of a subtest.
+const (
+	subtestLiteral  = iota // string literal passed to t.Run
+	subtestInferred        // value of a table entry
+	subtestDynamic         // not determined
+)
+
+// A subtestEntry is a subtest found by subtestEntries.
+type subtestEntry struct {
+	path   []string  // names passed to t.Run by the subtest and its parents
+	pos    token.Pos // position of the call to t.Run
+	source int       // least certain source of the names of path
+	format string    // format of a dynamic name (see subtestFormat)
+}
+
+// subtestEntries returns the subtests run by test d with t.Run in the order
+// they are declared (see findSubtests).
+func subtestEntries(imports map[string]string, d *ast.FuncDecl) []subtestEntry {
+	if d.Body == nil {
+		return nil
+	}
+	testingName := testingImportName(imports)
+	if testingName == "" {
+		return nil
+	}
+	params := testingParams(testingName, "T", d.Type)
+	if len(params) == 0 {
+		return nil
+	}
+	var entries []subtestEntry
+	collectSubtests(imports, testingName, params, d.Body, nil, subtestLiteral, &entries)
+	return entries
+}
+
+func collectSubtests(imports map[string]string, testingName string, params map[*ast.Object]bool,
+	body ast.Node, prefix []string, source int, entries *[]subtestEntry) {
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 || !isParamSelector(params, call.Fun, "Run") {
+			return true
+		}
+		subs, src := subtestNames(call.Args[0])
+		var format string
+		if src == subtestDynamic {
+			format, _ = subtestFormat(imports, call.Args[0])
+		}
+		if src < source {
+			src = source
+		}
+		for _, name := range subs {
+			path := append(prefix[:len(prefix):len(prefix)], name)
+			*entries = append(*entries, subtestEntry{path: path, pos: call.Pos(), source: src, format: format})
+		}
+		// Subtests of the subtest are run by the *testing.T parameter
+		// of its function.
+		if lit, ok := call.Args[1].(*ast.FuncLit); ok {
+			inner := testingParams(testingName, "T", lit.Type)
+			if len(inner) != 0 && len(subs) == 1 {
+				path := append(prefix[:len(prefix):len(prefix)], subs[0])
+				collectSubtests(imports, testingName, inner, lit.Body, path, src, entries)
+			}
+		}
+		return false
+	})
+}
+
+// subtestNames returns the possible values of the subtest name expression
+// x and their source or, if they cannot be determined, the expression in
+// braces.
+func subtestNames(x ast.Expr) ([]string, int) {
+	if s, ok := stringLit(x); ok {
+		return []string{s}, subtestLiteral
+	}
+	var names []string
+	switch x := x.(type) {
+	case *ast.SelectorExpr: // tt.name
+		if id, ok := x.X.(*ast.Ident); ok {
+			if lit := rangeValueLit(id); lit != nil {
+				names = fieldValues(lit, x.Sel.Name)
+			}
+		}
+	case *ast.Ident: // for name, tt := range map[string]T{...}
+		if lit := rangeKeyLit(x); lit != nil {
+			for _, elt := range lit.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					names = nil
+					break
+				}
+				s, ok := stringLit(kv.Key)
+				if !ok {
+					names = nil
+					break
+				}
+				names = append(names, s)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return []string{"{" + types.ExprString(x) + "}"}, subtestDynamic
+	}
+	return names, subtestInferred
+}
+
+// subtestFormat returns a format string, in the syntax of package fmt, that
+// describes the names produced by the subtest name expression x. For
+// example, the format of both fmt.Sprintf("case-%d", i) and
+// "case-" + strconv.Itoa(i) is "case-%d". Only calls to fmt.Sprintf with
+// a literal format, the common strconv formatting functions, string
+// literals and their concatenation are understood.
+func subtestFormat(imports map[string]string, x ast.Expr) (string, bool) {
+	switch x := x.(type) {
+	case *ast.ParenExpr:
+		return subtestFormat(imports, x.X)
+	case *ast.BasicLit:
+		s, ok := stringLit(x)
+		return strings.ReplaceAll(s, "%", "%%"), ok
+	case *ast.BinaryExpr:
+		if x.Op != token.ADD {
+			return "", false
+		}
+		left, ok := subtestFormat(imports, x.X)
+		if !ok {
+			return "", false
+		}
+		right, ok := subtestFormat(imports, x.Y)
+		return left + right, ok
+	case *ast.CallExpr:
+		fn, ok := x.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return "", false
+		}
+		ipath, sel, ok := packageSelector(imports, fn)
+		if !ok {
+			return "", false
+		}
+		switch ipath + "." + sel {
+		case "fmt.Sprintf":
+			if len(x.Args) != 0 {
+				return stringLit(x.Args[0])
+			}
+		case "strconv.Itoa":
+			return "%d", true
+		case "strconv.FormatInt", "strconv.FormatUint":
+			// Only base 10 is the same as the %d verb.
+			if len(x.Args) == 2 {
+				if base, ok := x.Args[1].(*ast.BasicLit); ok && base.Value == "10" {
+					return "%d", true
+				}
+			}
+		case "strconv.FormatBool":
+			return "%t", true
+		case "strconv.Quote":
+			return "%q", true
+		}
+	}
+	return "", false
+}
+
+func stringLit(x ast.Expr) (string, bool) {
+	lit, ok := x.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// rangeStmtX returns the expression ranged over by the range statement that
+// declares id, which must be its key (key is true) or value.
+func rangeStmtX(id *ast.Ident, key bool) ast.Expr {
+	if id.Obj == nil {
+		return nil
+	}
+	// The parser records range variables as declared by an assignment
+	// of the form "k, v = range x".
+	as, ok := id.Obj.Decl.(*ast.AssignStmt)
+	if !ok || len(as.Rhs) != 1 {
+		return nil
+	}
+	un, ok := as.Rhs[0].(*ast.UnaryExpr)
+	if !ok || un.Op != token.RANGE {
+		return nil
+	}
+	i := 0
+	if !key {
+		i = 1
+	}
+	if i >= len(as.Lhs) {
+		return nil
+	}
+	if lhs, ok := as.Lhs[i].(*ast.Ident); !ok || lhs.Obj != id.Obj {
+		return nil
+	}
+	return un.X
+}
+
+// compositeLit returns the composite literal x evaluates to, following
+// identifiers to their declaration.
+func compositeLit(x ast.Expr) *ast.CompositeLit {
+	switch x := x.(type) {
+	case *ast.CompositeLit:
+		return x
+	case *ast.UnaryExpr:
+		if x.Op == token.AND {
+			return compositeLit(x.X)
+		}
+	case *ast.ParenExpr:
+		return compositeLit(x.X)
+	case *ast.Ident:
+		if x.Obj == nil {
+			return nil
+		}
+		switch decl := x.Obj.Decl.(type) {
+		case *ast.AssignStmt:
+			for i, lhs := range decl.Lhs {
+				if id, ok := lhs.(*ast.Ident); ok && id.Obj == x.Obj && i < len(decl.Rhs) {
+					return compositeLit(decl.Rhs[i])
+				}
+			}
+		case *ast.ValueSpec:
+			for i, name := range decl.Names {
+				if name.Obj == x.Obj && i < len(decl.Values) {
+					return compositeLit(decl.Values[i])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rangeValueLit(id *ast.Ident) *ast.CompositeLit {
+	return compositeLit(rangeStmtX(id, false))
+}
+
+func rangeKeyLit(id *ast.Ident) *ast.CompositeLit {
+	lit := compositeLit(rangeStmtX(id, true))
+	if lit == nil {
+		return nil
+	}
+	if _, ok := lit.Type.(*ast.MapType); !ok {
+		return nil
+	}
+	return lit
+}
+
+// fieldValues returns the string values of field of the struct elements of
+// the slice, array or map literal lit. Nil is returned if any of the values
+// is not a string literal.
+func fieldValues(lit *ast.CompositeLit, field string) []string {
+	var elemType ast.Expr
+	switch t := lit.Type.(type) {
+	case *ast.ArrayType:
+		elemType = t.Elt
+	case *ast.MapType:
+		elemType = t.Value
+	default:
+		return nil
+	}
+	index := structFieldIndex(elemType, field)
+
+	var values []string
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			elt = kv.Value
+		}
+		el := compositeLit(elt)
+		if el == nil {
+			return nil
+		}
+		var value ast.Expr
+		for i, e := range el.Elts {
+			if kv, ok := e.(*ast.KeyValueExpr); ok {
+				if k, ok := kv.Key.(*ast.Ident); ok && k.Name == field {
+					value = kv.Value
+					break
+				}
+			} else if i == index {
+				value = e
+				break
+			}
+		}
+		s, ok := stringLit(value)
+		if !ok {
+			return nil
+		}
+		values = append(values, s)
+	}
+	return values
+}
+
+// structFieldIndex returns the index of field in struct type t, which may
+// be a pointer to or the name of a struct type declared in the same file,
+// or -1 if it cannot be determined.
+func structFieldIndex(t ast.Expr, field string) int {
+	for {
+		switch x := t.(type) {
+		case *ast.StarExpr:
+			t = x.X
+			continue
+		case *ast.Ident:
+			if x.Obj == nil {
+				return -1
+			}
+			ts, ok := x.Obj.Decl.(*ast.TypeSpec)
+			if !ok {
+				return -1
+			}
+			t = ts.Type
+			continue
+		case *ast.StructType:
+			i := 0
+			for _, f := range x.Fields.List {
+				if len(f.Names) == 0 {
+					i++ // embedded field
+					continue
+				}
+				for _, name := range f.Names {
+					if name.Name == field {
+						return i
+					}
+					i++
+				}
+			}
+		}
+		return -1
+	}
+}
+
+// A Subtest is a subtest found by ListSubtests.
+type Subtest struct {
+	// Name is the full name of the subtest as reported by go test, such
+	// as "TestFoo/a_case#01", and Original is its full name before it was
+	// rewritten and disambiguated by the testing package, such as
+	// "TestFoo/a case".
+	Name     string `json:"name"`
+	Original string `json:"original"`
+	Test     string `json:"test"`
+	Filename string `json:"filename"`
+	Line     int    `json:"line"` // line of the call to t.Run
+
+	// Pattern is the -run pattern that selects exactly the subtest. For
+	// dynamic subtests it selects their closest parent with a known name.
+	Pattern string `json:"pattern"`
+
+	// Inferred is set if the name was taken from the entries of a table
+	// driven test and Dynamic if it could not be determined, in which case
+	// it contains the name expression in braces (see findSubtests).
+	Inferred bool `json:"inferred,omitempty"`
+	Dynamic  bool `json:"dynamic,omitempty"`
+
+	// Format describes the names of a dynamic subtest, if known, such as
+	// "case-%d" for a subtest named with fmt.Sprintf("case-%d", i) (see
+	// subtestFormat).
+	Format string `json:"format,omitempty"`
+}
+
+// ListSubtests returns the subtests of the tests of the package in dir
+// matched by opts (see ListTests), in the order they are declared. Names
+// are rewritten and disambiguated as they would be by the testing package
+// assuming that each call to t.Run is made once per name.
+func ListSubtests(ctxt *build.Context, dir string, opts *ListOptions) ([]Subtest, error) {
+	res, err := ListTests(ctxt, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	files := make(map[string]*ast.File)
+	subtests := []Subtest{}
+	for _, def := range res.Tests {
+		af, ok := files[def.Filename]
+		if !ok {
+			// Object resolution is used to find the names of table driven
+			// subtests.
+			af, _ = util.ParseFile(fset, ctxt, nil, dir, def.Filename, 0)
+			files[def.Filename] = af
+		}
+		if af == nil {
+			continue
+		}
+		d := testFuncDecl(af, def.Name)
+		if d == nil {
+			continue
+		}
+		for _, ns := range nameSubtests(def.Name, subtestEntries(importNames(af), d)) {
+			subtests = append(subtests, Subtest{
+				Name:     ns.name,
+				Original: def.Name + "/" + strings.Join(ns.path, "/"),
+				Test:     def.Name,
+				Filename: def.Filename,
+				Line:     fset.Position(ns.pos).Line,
+				Pattern:  fullNamePattern(ns.selected),
+				Inferred: ns.source == subtestInferred,
+				Dynamic:  ns.source == subtestDynamic,
+				Format:   ns.format,
+			})
+		}
+	}
+	if opts != nil && opts.SortSubtests == subtestOrderName {
+		sort.SliceStable(subtests, func(i, j int) bool {
+			return subtests[i].Name < subtests[j].Name
+		})
+	}
+	return subtests, nil
+}
+
+// Orders of subtests (see ListOptions.SortSubtests).
+const (
+	subtestOrderPosition = "position"
+	subtestOrderName     = "name"
+)
+
+// checkSubtestOrder returns an error if order is not a valid subtest order.
+func checkSubtestOrder(order string) error {
+	switch order {
+	case "", subtestOrderPosition, subtestOrderName:
+		return nil
+	}
+	return fmt.Errorf("invalid subtest order: %q (must be one of: position or name)", order)
+}
+
+// sortSubtests sorts the Subtests, and GoTestNames, of def by order. The
+// subtests are found in the order they are declared, so only sorting by
+// name is required. Sorting is stable and, since the names of dynamic
+// subtests are their name expression in braces, deterministic.
+func sortSubtests(def *FuncDefinition, order string) {
+	if order != subtestOrderName || len(def.Subtests) < 2 {
+		return
+	}
+	index := make([]int, len(def.Subtests))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		return def.Subtests[index[i]] < def.Subtests[index[j]]
+	})
+	subtests := make([]string, len(index))
+	for i, x := range index {
+		subtests[i] = def.Subtests[x]
+	}
+	if len(def.GoTestNames) == len(index) {
+		names := make([]string, len(index))
+		for i, x := range index {
+			names[i] = def.GoTestNames[x]
+		}
+		def.GoTestNames = names
+	}
+	def.Subtests = subtests
+}
+
+// A namedSubtest is a subtestEntry with the full name given to it by the
+// testing package.
+type namedSubtest struct {
+	subtestEntry
+	name     string // full name, such as "TestFoo/a_case#01"
+	selected string // full name of the closest parent with a known name
+}
+
+// nameSubtests returns the full names given by the testing package to the
+// subtests entries of test, which must be in the order they are declared,
+// assuming that each call to t.Run is made once per name. Dynamic subtests
+// keep their name expression (see findSubtests) and select their closest
+// parent with a known name.
+func nameSubtests(test string, entries []subtestEntry) []namedSubtest {
+	var namer subtestNamer
+	// Full names of the subtests and the full names they select keyed by
+	// their path.
+	fullNames := make(map[string]string)
+	selected := make(map[string]string)
+	named := make([]namedSubtest, len(entries))
+	for i, e := range entries {
+		key := strings.Join(e.path, "/")
+		parent, sel := test, test
+		if len(e.path) > 1 {
+			pkey := strings.Join(e.path[:len(e.path)-1], "/")
+			parent, sel = fullNames[pkey], selected[pkey]
+		}
+		name := parent + "/" + e.path[len(e.path)-1]
+		if e.source != subtestDynamic {
+			name = namer.unique(parent, e.path[len(e.path)-1])
+			sel = name
+		}
+		fullNames[key] = name
+		selected[key] = sel
+		named[i] = namedSubtest{subtestEntry: e, name: name, selected: sel}
+	}
+	return named
+}
+
+// goTestNames returns the full names of the subtests of test d as they are
+// reported by go test (see nameSubtests).
+func goTestNames(imports map[string]string, d *ast.FuncDecl) []string {
+	named := nameSubtests(d.Name.Name, subtestEntries(imports, d))
+	if len(named) == 0 {
+		return nil
+	}
+	names := make([]string, len(named))
+	for i, ns := range named {
+		names[i] = ns.name
+	}
+	return names
+}
+
+// testFuncDecl returns the top-level function named name of af.
+func testFuncDecl(af *ast.File, name string) *ast.FuncDecl {
+	for _, decl := range af.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == name {
+			return d
+		}
+	}
+	return nil
+}
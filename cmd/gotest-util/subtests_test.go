@@ -0,0 +1,98 @@
+package main
+
+import (
+	"go/build"
+	"go/parser"
+	"reflect"
+	"testing"
+)
+
+func TestListSubtestsDuplicates(t *testing.T) {
+	dir := writeModule(t, map[string]string{"m_test.go": `package m
+
+import "testing"
+
+func TestTable(t *testing.T) {
+	tests := []struct {
+		name string
+	}{
+		{"same case"},
+		{"other"},
+		{"same case"},
+		{"same case"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {})
+	}
+	t.Run("other", func(t *testing.T) {})
+}
+`})
+	subtests, err := ListSubtests(&build.Default, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type name struct{ Name, Original, Pattern string }
+	want := []name{
+		{"TestTable/same_case", "TestTable/same case", "^TestTable$/^same_case$"},
+		{"TestTable/other", "TestTable/other", "^TestTable$/^other$"},
+		{"TestTable/same_case#01", "TestTable/same case", "^TestTable$/^same_case#01$"},
+		{"TestTable/same_case#02", "TestTable/same case", "^TestTable$/^same_case#02$"},
+		{"TestTable/other#01", "TestTable/other", "^TestTable$/^other#01$"},
+	}
+	var got []name
+	for _, st := range subtests {
+		got = append(got, name{st.Name, st.Original, st.Pattern})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListSubtests:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestSubtestFormat(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string // "" if no format
+	}{
+		{`fmt.Sprintf("case-%d", i)`, "case-%d"},
+		{`fmt.Sprintf(format, i)`, ""},
+		{`"n=" + strconv.Itoa(i)`, "n=%d"},
+		{`strconv.FormatInt(n, 10) + "%"`, "%d%%"},
+		{`strconv.FormatInt(n, 16)`, ""},
+		{`strconv.Quote(s)`, "%q"},
+		{`(strconv.FormatBool(b))`, "%t"},
+		{`name(i)`, ""},
+		{`f.Sprintf("%d", i)`, ""}, // not package fmt
+	}
+	imports := map[string]string{"fmt": "fmt", "strconv": "strconv"}
+	for _, test := range tests {
+		x, err := parser.ParseExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := subtestFormat(imports, x)
+		if ok != (test.want != "") || got != test.want {
+			t.Errorf("subtestFormat(%s) = %q, %t; want: %q", test.expr, got, ok, test.want)
+		}
+	}
+}
+
+func TestSortSubtests(t *testing.T) {
+	def := &FuncDefinition{
+		Subtests:    []string{"b", "{tt.name}", "a", "b"},
+		GoTestNames: []string{"T/b", "T/{tt.name}", "T/a", "T/b#01"},
+	}
+	sortSubtests(def, subtestOrderPosition)
+	if want := []string{"b", "{tt.name}", "a", "b"}; !reflect.DeepEqual(def.Subtests, want) {
+		t.Errorf("position: Subtests = %q; want: %q", def.Subtests, want)
+	}
+	sortSubtests(def, subtestOrderName)
+	if want := []string{"a", "b", "b", "{tt.name}"}; !reflect.DeepEqual(def.Subtests, want) {
+		t.Errorf("name: Subtests = %q; want: %q", def.Subtests, want)
+	}
+	if want := []string{"T/a", "T/b", "T/b#01", "T/{tt.name}"}; !reflect.DeepEqual(def.GoTestNames, want) {
+		t.Errorf("name: GoTestNames = %q; want: %q", def.GoTestNames, want)
+	}
+	if err := checkSubtestOrder("size"); err == nil {
+		t.Error("checkSubtestOrder: expected an error for an invalid order")
+	}
+}
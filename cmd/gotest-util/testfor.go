@@ -0,0 +1,111 @@
+package main
+
+import (
+	"go/ast"
+	"sort"
+	"strings"
+)
+
+// recvTypeName returns the name of the receiver type of method d or an
+// empty string if d is not a method.
+func recvTypeName(d *ast.FuncDecl) string {
+	if d.Recv == nil || len(d.Recv.List) == 0 {
+		return ""
+	}
+	typ := d.Recv.List[0].Type
+	for {
+		switch x := typ.(type) {
+		case *ast.StarExpr:
+			typ = x.X
+		case *ast.ParenExpr:
+			typ = x.X
+		case *ast.IndexExpr: // generic receiver: T[E]
+			typ = x.X
+		case *ast.IndexListExpr: // generic receiver: T[K, V]
+			typ = x.X
+		case *ast.Ident:
+			return x.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// A TestMatch is a test that conventionally tests a function. Matches with
+// a lower Rank are more specific.
+type TestMatch struct {
+	FuncRef
+	Rank int `json:"rank"`
+}
+
+// FindTestsFor returns the tests that, by naming convention, test the
+// function or method d ranked by the specificity of their name. For a
+// function Foo the names are, in order of rank:
+//
+//	0: TestFoo
+//	1: Test_Foo
+//	2: TestFoo_*, Test_Foo_* (e.g. TestFoo_EdgeCase)
+//
+// For a method T.Foo:
+//
+//	0: TestT_Foo, Test_T_Foo
+//	1: TestFoo (including suite methods such as (*Suite).TestFoo)
+//	2: TestT_Foo_*, Test_T_Foo_*, TestFoo_*
+func FindTestsFor(d *ast.FuncDecl, tests []*FuncDefinition) []TestMatch {
+	name := d.Name.Name
+	var exact [][]string // names by rank
+	var prefixes []string
+	if recv := recvTypeName(d); recv != "" {
+		exact = [][]string{
+			{"Test" + recv + "_" + name, "Test_" + recv + "_" + name},
+			{"Test" + name},
+		}
+		prefixes = []string{
+			"Test" + recv + "_" + name + "_",
+			"Test_" + recv + "_" + name + "_",
+			"Test" + name + "_",
+		}
+	} else {
+		exact = [][]string{
+			{"Test" + name},
+			{"Test_" + name},
+		}
+		prefixes = []string{
+			"Test" + name + "_",
+			"Test_" + name + "_",
+		}
+	}
+
+	rank := func(test string) (int, bool) {
+		for i, names := range exact {
+			for _, s := range names {
+				if test == s {
+					return i, true
+				}
+			}
+		}
+		for _, s := range prefixes {
+			if strings.HasPrefix(test, s) {
+				return len(exact), true
+			}
+		}
+		return 0, false
+	}
+
+	var matches []TestMatch
+	for _, t := range tests {
+		if r, ok := rank(t.Name); ok {
+			matches = append(matches, TestMatch{
+				FuncRef: FuncRef{Name: t.Name, Filename: t.Filename, Line: t.Line},
+				Rank:    r,
+			})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Rank != matches[j].Rank {
+			return matches[i].Rank < matches[j].Rank
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return matches
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// A TestName is the test, and possibly subtest, containing a position and
+// the pattern that runs exactly it.
+type TestName struct {
+	Name    string `json:"name"`
+	Subtest string `json:"subtest,omitempty"`
+
+	// Pattern is the pattern that selects the test and is passed to the
+	// go test flag Flag ("-run" or, for benchmarks, "-bench").
+	Pattern string `json:"pattern"`
+	Flag    string `json:"flag"`
+
+	// Warnings explain why the subtest containing the position could
+	// not be determined, in which case Pattern selects its parent.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// TestNameAt returns the test containing the position p of a file, which is
+// either a line and column or an offset (see ParseFileQuery). If p is
+// within the function passed to t.Run (or b.Run) the subtest is included.
+func TestNameAt(p *token.Position, src interface{}) (*TestName, error) {
+	fset := token.NewFileSet()
+	// Object resolution is used to find the names of table driven subtests.
+	af, err := parser.ParseFile(fset, p.Filename, src, 0)
+	if err != nil && af == nil {
+		return nil, err
+	}
+	file := fset.File(af.Pos())
+	if file == nil {
+		return nil, errors.New("ast: no pos for file")
+	}
+	pos, err := queryPos(file, p)
+	if err != nil {
+		return nil, err
+	}
+	d := funcDeclAt(af, pos, false)
+	if d == nil {
+		p := file.Position(pos)
+		return nil, &NoContainingFunctionError{p.Filename, p.Line, p.Column}
+	}
+
+	tn := &TestName{Name: d.Name.Name, Flag: "-run"}
+	kind := testFuncKind(d.Name.Name)
+	if isTestMain(d) {
+		return nil, errors.New("TestMain is not a test: it runs the tests of the package")
+	}
+	if kind == kindNone || d.Recv != nil {
+		return nil, fmt.Errorf("%s is not a test, benchmark, example or fuzz target", d.Name.Name)
+	}
+	var subtests []string
+	switch kind {
+	case kindTest:
+		subtests, tn.Warnings = subtestPath(importNames(af), "T", d, pos)
+	case kindBenchmark:
+		tn.Flag = "-bench"
+		subtests, tn.Warnings = subtestPath(importNames(af), "B", d, pos)
+	}
+	tn.Subtest = strings.Join(subtests, "/")
+	tn.Pattern = RunPattern(tn.Name, tn.Subtest)
+	return tn, nil
+}
+
+// subtestPath returns the names of the nested subtests, run with t.Run (or
+// b.Run for typeName "B"), of d whose function contains pos. If the name
+// of a subtest cannot be determined the names of its parents are returned
+// with a warning.
+func subtestPath(imports map[string]string, typeName string, d *ast.FuncDecl, pos token.Pos) ([]string, []string) {
+	testingName := testingImportName(imports)
+	if testingName == "" || d.Body == nil {
+		return nil, nil
+	}
+	params := testingParams(testingName, typeName, d.Type)
+	var names []string
+	body := d.Body
+	for len(params) != 0 {
+		var call *ast.CallExpr
+		var lit *ast.FuncLit
+		ast.Inspect(body, func(n ast.Node) bool {
+			if call != nil {
+				return false
+			}
+			c, ok := n.(*ast.CallExpr)
+			if !ok || len(c.Args) != 2 || !isParamSelector(params, c.Fun, "Run") {
+				return true
+			}
+			if fn, ok := c.Args[1].(*ast.FuncLit); ok && fn.Pos() <= pos && pos <= fn.End() {
+				call, lit = c, fn
+				return false
+			}
+			return true
+		})
+		if call == nil {
+			break
+		}
+		name, ok := stringLit(call.Args[0])
+		if !ok {
+			// A table driven test with a single case.
+			subs, source := subtestNames(call.Args[0])
+			if len(subs) != 1 || source == subtestDynamic {
+				return names, []string{fmt.Sprintf("the name of the subtest %s cannot be determined",
+					types.ExprString(call.Args[0]))}
+			}
+			name = subs[0]
+		}
+		names = append(names, name)
+		params = testingParams(testingName, typeName, lit.Type)
+		body = lit.Body
+	}
+	return names, nil
+}
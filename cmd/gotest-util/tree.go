@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A resultNode is a package, test or subtest of a summary tree.
+type resultNode struct {
+	name     string
+	result   *TestResult // nil if the test did not report a result
+	running  bool        // the test started but did not finish
+	children map[string]*resultNode
+}
+
+func (n *resultNode) child(name string) *resultNode {
+	c := n.children[name]
+	if c == nil {
+		if n.children == nil {
+			n.children = make(map[string]*resultNode)
+		}
+		c = &resultNode{name: name}
+		n.children[name] = c
+	}
+	return c
+}
+
+func (n *resultNode) sortedChildren() []*resultNode {
+	a := make([]*resultNode, 0, len(n.children))
+	for _, c := range n.children {
+		a = append(a, c)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].name < a[j].name })
+	return a
+}
+
+// summaryTree returns the packages of s with their tests and subtests as
+// children. Subtests are nested by splitting test names on '/'.
+func summaryTree(s *Summary) *resultNode {
+	root := new(resultNode)
+	for i := range s.Packages {
+		root.child(s.Packages[i].Package).result = &s.Packages[i]
+	}
+	add := func(r *TestResult, running bool) {
+		n := root.child(r.Package)
+		for _, name := range strings.Split(r.Test, "/") {
+			n = n.child(name)
+		}
+		n.result = r
+		n.running = running
+	}
+	for i := range s.Tests {
+		add(&s.Tests[i], false)
+	}
+	for i := range s.Running {
+		if s.Running[i].Test != "" {
+			add(&s.Running[i], true)
+		}
+	}
+	return root
+}
+
+// ANSI escape sequences used to color the markers of a summary tree.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// writeSummaryTree writes s to w as a tree of packages, tests and subtests,
+// each indented beneath its parent and marked with its outcome and elapsed
+// time. If color is true the markers are colored with ANSI escapes.
+func writeSummaryTree(w io.Writer, s *Summary, color bool) error {
+	bw := bufio.NewWriter(w)
+	var walk func(n *resultNode, depth int)
+	walk = func(n *resultNode, depth int) {
+		marker, code := "?", ""
+		switch {
+		case n.running:
+			marker, code = "RUNNING", ansiYellow
+		case n.result == nil:
+			// Parent of a subtest that did not report a result.
+		case n.result.Action == "pass":
+			marker, code = "PASS", ansiGreen
+		case n.result.Action == "fail":
+			marker, code = "FAIL", ansiRed
+		case n.result.Action == "skip":
+			marker, code = "SKIP", ansiYellow
+		}
+		if color && code != "" {
+			marker = code + marker + ansiReset
+		}
+		fmt.Fprintf(bw, "%s%s %s", strings.Repeat("  ", depth), marker, n.name)
+		if n.result != nil && n.result.Elapsed > 0 {
+			fmt.Fprintf(bw, " (%.2fs)", n.result.Elapsed)
+		}
+		bw.WriteByte('\n')
+		for _, c := range n.sortedChildren() {
+			walk(c, depth+1)
+		}
+	}
+	for _, pkg := range summaryTree(s).sortedChildren() {
+		walk(pkg, 0)
+	}
+	fmt.Fprintf(bw, "\n%d passed, %d failed, %d skipped\n", s.Passed, s.Failed, s.Skipped)
+	return bw.Flush()
+}
+
+// useColor reports if the output written to stdout should be colored: it
+// is not compressed, is a terminal and the NO_COLOR environment variable is
+// not set.
+func useColor(compressed bool) bool {
+	if compressed || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
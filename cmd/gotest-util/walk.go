@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// skipDir reports if the directory name should be skipped when walking
+// packages. Like the go command, directories named "testdata" or "vendor"
+// and those beginning with "." or "_" are ignored.
+func skipDir(name string) bool {
+	return name == "testdata" || name == "vendor" ||
+		strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// walkPackageDirs walks the directory tree rooted at root and calls fn for
+// each directory that contains Go files with the sorted names of those
+// files. Directories ignored by the go command are skipped. The walk stops
+// with the context's error if ctx is cancelled.
+func walkPackageDirs(ctx context.Context, root string, fn func(dir string, names []string) error) error {
+	root = filepath.Clean(root)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && skipDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		des, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, de := range des {
+			if !de.IsDir() && strings.HasSuffix(de.Name(), ".go") {
+				names = append(names, de.Name())
+			}
+		}
+		if len(names) == 0 {
+			return nil
+		}
+		return fn(path, names) // os.ReadDir returns sorted entries
+	})
+}
@@ -5,13 +5,14 @@ go 1.19
 require (
 	github.com/charlievieth/buildutil v0.0.15
 	github.com/spf13/cobra v1.5.0
+	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4
 	golang.org/x/tools v0.1.13-0.20220805170418-06d96ee8fcfe
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/charlievieth/reonce v1.2.1 // indirect
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
 	golang.org/x/sys v0.0.0-20220913175220-63ea55921009 // indirect
 )